@@ -1,544 +1,837 @@
 package main
 
 import (
-	"archive/tar"
-	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"hash"
-	"io"
-	"net/http"
-	"net/url"
+	"maps"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"sort"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/klauspost/compress/zstd"
-	"github.com/mholt/archiver/v4"
+	"github.com/piper-tts-go/piper-gen/piperpkg"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"github.com/zeebo/xxh3"
 )
 
-type Meta struct {
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid mode %q", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+type catalogVoice struct {
+	// Version pins the voices repository tag, overriding -voice-version.
 	Version string
-	Hash    xxh3.Uint128
+	Paths   []string
+
+	Language, Dataset, Quality string
 }
 
-const (
-	ArchiveFilename  = "dist.tzst"
-	MetadataFilename = "dist.json"
-)
+type catalogRelease struct {
+	// Version pins the piper release, overriding -piper-version.
+	Version string
+	// OS and Arch are the GOOS and GOARCH the release runs on.
+	OS, Arch string
+	// Asset is the file name of the archive in the release.
+	Asset       string
+	Paths       []string
+	StripPrefix string
+}
 
-func download(rootDir string, srcURL string) (filename string, retErr error) {
-	log.Info().Str("url", srcURL).Msg("downloading file")
-	filename = filepath.Join(
-		rootDir,
-		"piper-gen.cache",
-		url.QueryEscape(srcURL),
-	)
-	if _, err := os.Stat(filename); err == nil {
-		return filename, nil
+func voiceSpecs(voices map[string]piperpkg.VoiceSpec) []piperpkg.VoiceSpec {
+	specs := make([]piperpkg.VoiceSpec, 0, len(voices))
+	for _, name := range slices.Sorted(maps.Keys(voices)) {
+		specs = append(specs, voices[name])
 	}
+	return specs
+}
 
-	os.MkdirAll(filepath.Dir(filename), 0o755)
-
-	out, err := os.Create(filename)
-	defer func() {
-		closeErr := out.Close()
-		if closeErr != nil && retErr == nil {
-			retErr = closeErr
-		}
-		if retErr != nil {
-			retErr = fmt.Errorf("failed to download %q: %w", srcURL, retErr)
-		}
-	}()
+func catalogSource(prefix, p string) string {
+	if strings.Contains(p, "://") || filepath.IsAbs(p) {
+		return p
+	}
+	return prefix + "/" + p
+}
 
-	response, err := http.Get(srcURL)
-	if err != nil {
-		return "", fmt.Errorf("failed to download %q: %w", srcURL, err)
+func parseSince(s string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
 	}
-	defer response.Body.Close()
+	return time.Parse(time.RFC3339, s)
+}
 
-	if _, err := io.Copy(out, response.Body); err != nil {
-		return "", fmt.Errorf("failed to download %q: %w", srcURL, err)
+func parseNameList(list string) map[string]bool {
+	names := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[name] = true
+		}
 	}
-	return filename, nil
+	return names
 }
 
-func Extract(ctx context.Context, rootDir string, f archiver.File) (retErr error) {
-	info, err := f.Stat()
+func prepareDir(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
 	if err != nil {
-		return fmt.Errorf("failed to read file info: %w", err)
+		return "", fmt.Errorf("failed to resolve %q: %w", dir, err)
 	}
-	if info.IsDir() {
-		return nil
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		return "", fmt.Errorf("%q is not a directory", dir)
 	}
-
-	filename := filepath.Join(rootDir, filepath.Clean(filepath.FromSlash(f.NameInArchive)))
-	if _, err := os.Stat(filename); err == nil {
-		return nil
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create %q: %w", dir, err)
 	}
-
-	os.MkdirAll(filepath.Dir(filename), 0o755)
-
-	if info.Mode().Type()&os.ModeSymlink == os.ModeSymlink {
-		err := os.Symlink(f.LinkTarget, filename)
-		if err != nil {
-			return fmt.Errorf("failed to symlink %q to %q: %w", filename, f.LinkTarget, err)
-		}
-	}
-
-	if !info.Mode().IsRegular() {
-		return nil
+	f, err := os.CreateTemp(dir, ".piper-gen-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("%q is not writable: %w", dir, err)
 	}
+	f.Close()
+	os.Remove(f.Name())
+	return dir, nil
+}
 
-	reader, err := f.Open()
+func loadConfig(filename string) error {
+	src, err := os.ReadFile(filename)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		return fmt.Errorf("failed to read config: %w", err)
 	}
-	defer reader.Close()
-	writer, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, f.Mode().Perm())
-	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(src, &config); err != nil {
+		return fmt.Errorf("failed to parse config %q: %w", filename, err)
 	}
-	defer func() {
-		closeErr := writer.Close()
-		if retErr != nil {
-			return
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for _, name := range slices.Sorted(maps.Keys(config)) {
+		if flag.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("unknown option %q in config %q", name, filename)
+		}
+		if explicit[name] {
+			continue
 		}
-		if closeErr != nil {
-			retErr = fmt.Errorf("failed to close file: %w", closeErr)
+		var values []json.RawMessage
+		if err := json.Unmarshal(config[name], &values); err != nil {
+			values = []json.RawMessage{config[name]}
+		}
+		for _, raw := range values {
+			// strings are unquoted, numbers and booleans are used as written
+			value := string(raw)
+			var s string
+			if json.Unmarshal(raw, &s) == nil {
+				value = s
+			}
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("invalid value for %q in config %q: %w", name, filename, err)
+			}
 		}
-	}()
-	if _, err := io.Copy(writer, reader); err != nil {
-		return fmt.Errorf("failed to copy file: %w", err)
 	}
 	return nil
 }
 
-type voiceInfo struct {
-	ONNX      string
-	ModelCard string
-	JSON      string
+var pathFlags = map[string]bool{
+	"config": true, "report": true, "checksums": true, "signing-key": true, "ca-cert": true, "license-file": true,
+	"replace": true, "phonemizer-data": true, "voice-base-url": true, "piper-base-url": true,
 }
 
-func hashFile(h hash.Hash, filename string) error {
-	f, err := os.Open(filename)
-	if err != nil {
-		return err
-	}
-	if _, err := io.Copy(h, f); err != nil {
-		return err
+func commandArgs(args []string, omit, paths map[string]bool) []string {
+	kept := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || arg == "--" {
+			kept = append(kept, args[i:]...)
+			break
+		}
+		f := flag.Lookup(name)
+		if f == nil {
+			// left for flag.Parse to report
+			kept = append(kept, arg)
+			continue
+		}
+		boolFlag, _ := f.Value.(interface{ IsBoolFlag() bool })
+		takesValue := !hasValue && (boolFlag == nil || !boolFlag.IsBoolFlag())
+		if omit[name] {
+			if takesValue {
+				i++
+			}
+			continue
+		}
+		if hasValue && paths[name] {
+			arg = strings.TrimSuffix(arg, value) + absPathArg(name, value)
+		}
+		kept = append(kept, arg)
+		if takesValue && i+1 < len(args) {
+			i++
+			value = args[i]
+			if paths[name] {
+				value = absPathArg(name, value)
+			}
+			kept = append(kept, value)
+		}
 	}
-	return nil
+	return kept
 }
 
-func run(workingDirectory string, program string, args ...string) error {
-	stderr := bytes.NewBuffer(nil)
-	cmd := exec.Command(program, args...)
-	cmd.Stderr = stderr
-	cmd.Stdout = stderr
-	cmd.Dir = workingDirectory
-	log.Info().Str("program", program).Strs("args", args).Msg("running executable command")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to run `%s %s`: %w: %s", program, strings.Join(args, " "), err, stderr.Bytes())
+func absPathArg(name, value string) string {
+	prefix, target := "", value
+	if name == "replace" {
+		old, replacement, ok := strings.Cut(value, "=")
+		if !ok || strings.Contains(replacement, "@") {
+			return value
+		}
+		prefix, target = old+"=", replacement
 	}
-	return nil
+	if target == "" || strings.Contains(target, "://") || filepath.IsAbs(target) {
+		return value
+	}
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		return value
+	}
+	return prefix + abs
 }
 
-func generatePackage(voicePkg bool, pkgDir, embedPkgName, pkgPath string, assetName string, version string, embedPaths ...string) error {
-	embedPaths = append([]string{
-		ArchiveFilename,
-		MetadataFilename,
-	}, embedPaths...)
-
-	embedGo := []byte(`// GENERATED FILE
-
-package ` + embedPkgName + `
-
-import (
-	"embed"
-	"github.com/piper-tts-go/piper-go-asset"
-)
-
-var (
-	//go:embed ` + strings.Join(embedPaths, " ") + `
-	fs embed.FS
-
-	Asset = asset.Asset{Name: "` + assetName + `", FS: fs}
-)
-`)
-	goMod := []byte(`
-module ` + pkgPath + `
-
-go 1.21
-
-`)
-
-	license := []byte(`
-MIT License
-
-Copyright (c) 2023 Amity Bell
-Copyright (c) 2025 Dharma Bellamkonda
-
-Permission is hereby granted, free of charge, to any person obtaining a copy
-of this software and associated documentation files (the "Software"), to deal
-in the Software without restriction, including without limitation the rights
-to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
-copies of the Software, and to permit persons to whom the Software is
-furnished to do so, subject to the following conditions:
-
-The above copyright notice and this permission notice shall be included in all
-copies or substantial portions of the Software.
-
-THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
-IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
-FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
-AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
-LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
-OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
-`)
-
-	distLicense := "https://github.com/piper-tts-go/piper"
-	if voicePkg {
-		distLicense = "[MODEL_CARD.txt](MODEL_CARD.txt)"
+func extract(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet("extract", flag.ExitOnError)
+	overwrite := flags.Bool("overwrite", false, "replace existing files instead of keeping those matching the archive entry's size")
+	logLevel := flags.String("log-level", "info", "minimum level to log: trace, debug, info, warn or error")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: piper-gen extract [-overwrite] [-log-level level] <archive or package directory> <output directory>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	level, err := zerolog.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid -log-level")
 	}
+	zerolog.SetGlobalLevel(level)
+	src, outDir := flags.Arg(0), flags.Arg(1)
+	names, err := piperpkg.ExtractArchive(ctx, src, outDir, *overwrite, func(f piperpkg.ExtractedFile) {
+		log.Info().Str("entry", f.Name).Int64("size", f.Size).Str("path", f.Path).Msg("extracted")
+	})
+	if err != nil {
+		log.Fatal().Err(err).Str("archive", src).Msg("failed to extract archive")
+	}
+	log.Info().Str("dir", outDir).Int("entries", len(names)).Msg("extracted archive")
+}
 
-	readmeMd := []byte(`
-Package auto-generated by https://github.com/piper-tts-go/piper-gen
+func info(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet("info", flag.ExitOnError)
+	metadataFilename := flags.String("metadata-filename", piperpkg.MetadataFilename, "name of the metadata file in the package")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: piper-gen info [-metadata-filename name] <package directory>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	pkgInfo, err := piperpkg.ReadPackage(flags.Arg(0), *metadataFilename)
+	if err != nil {
+		log.Fatal().Err(err).Str("dir", flags.Arg(0)).Msg("failed to read package")
+	}
+	src, err := json.MarshalIndent(pkgInfo, "", "\t")
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to marshal package info")
+	}
+	fmt.Println(string(src))
+}
 
-- Package license: See [LICENSE](LICENSE)
-- dist.tar.zst license: See ` + distLicense + `
-- See https://github.com/piper-tts-go/piper for docs
-`)
+func rebuildPackages(ctx context.Context, builder *piperpkg.PackageBuilder, pkgDirs []string) {
+	failed := false
+	for _, pkgDir := range pkgDirs {
+		meta, err := builder.Rebuild(ctx, pkgDir)
+		if err != nil {
+			log.Error().Err(err).Str("dir", pkgDir).Msg("failed to rebuild package")
+			failed = true
+			continue
+		}
+		log.Info().Str("dir", pkgDir).Str("version", meta.Version).Str("hash", meta.Hash.String()).Msg("rebuilt package")
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
 
-	if err := os.WriteFile(filepath.Join(pkgDir, "embed.go"), embedGo, 0o644); err != nil {
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if len(os.Args) > 1 && os.Args[1] == "extract" {
+		extract(ctx, os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "info" {
+		info(ctx, os.Args[2:])
+		return
+	}
+	// rebuild takes the same flags as generating packages
+	rebuild := len(os.Args) > 1 && os.Args[1] == "rebuild"
+	dir := flag.String("dir", "", "root directory to extract store files")
+	logLevel := flag.String("log-level", "info", "minimum level to log: trace, debug, info, warn or error")
+	logFormat := flag.String("log-format", "console", "log output format: console or json")
+	reportFilename := flag.String("report", "", "write a JSON summary of the generated packages to this file")
+	downloader := &piperpkg.Downloader{}
+	builder := &piperpkg.PackageBuilder{Downloader: downloader}
+	flag.BoolVar(&builder.SkipBuild, "skip-build", false, "generate package files without running `go mod tidy` and `go build`")
+	update := flag.Bool("update", false, "only regenerate packages whose recorded version differs from the target version")
+	builder.GoEnv = maps.Clone(piperpkg.DefaultGoEnv)
+	flag.Func("go-env", "set KEY=VALUE in the environment of go commands building generated packages, overriding the pinned GOFLAGS, GOPROXY, GOSUMDB, GONOPROXY, GONOSUMDB, GOPRIVATE and CGO_ENABLED; may be repeated", func(s string) error {
+		key, value, ok := strings.Cut(s, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("expected KEY=VALUE, got %q", s)
+		}
+		builder.GoEnv[key] = value
+		return nil
+	})
+	flag.BoolVar(&builder.SkipTidy, "skip-tidy", false, "build generated packages with go build -mod=mod instead of running go mod tidy, for builds without network access; needs -asset-version, and -replace "+piperpkg.AssetModulePath+"=<dir> unless the module is cached")
+	flag.Int64Var(&builder.WarnArchiveSize, "warn-archive-size", 50<<20, "warn when an embedded archive is larger than this many bytes, or 0 to never warn")
+	flag.Int64Var(&builder.MaxArchiveSize, "error-archive-size", 0, "fail when an embedded archive is larger than this many bytes, or 0 for no limit")
+	flag.IntVar(&builder.TidyRetries, "tidy-retries", 3, "times to retry go mod tidy after a network error")
+	flag.BoolVar(&builder.Incremental, "incremental", false, "keep existing voice packages whose downloaded files are unchanged, and reuse the compressed unchanged files of those that changed")
+	flag.BoolVar(&builder.Strip, "strip", false, "strip debug symbols from piper binaries for the host OS with strip, if installed")
+	flag.BoolVar(&builder.SmokeTest, "smoke-test", false, "run the piper binary of the package for the host platform to check it works")
+	since := flag.String("since", "", "only generate voices and piper binaries with a file modified upstream after this date, e.g. 2025-01-31 or 2025-01-31T12:00:00Z")
+	preflight := flag.Bool("preflight", false, "check that every selected voice and piper URL is reachable before downloading any")
+	verifySignatures := flag.Bool("verify-signatures", false, "verify every download against the -checksums files, whose signatures are checked with -signing-key, before generating any package")
+	var checksumsURLs []string
+	flag.Func("checksums", "URL or path of a SHA256SUMS file listing downloads relative to it, signed in <url>.sig; may be repeated", func(s string) error {
+		checksumsURLs = append(checksumsURLs, s)
+		return nil
+	})
+	signingKey := flag.String("signing-key", "", "file holding the ed25519 public key, base64 or in signify format, that signs the -checksums files")
+	noLock := flag.Bool("no-lock", false, "don't lock -dir against concurrent runs, for callers isolating runs themselves")
+	restart := flag.Bool("restart", false, "ignore the checkpoint of an interrupted run and regenerate every package")
+	flag.BoolVar(&builder.KeepOnError, "keep-on-error", false, "keep the directory of a package that failed to generate as <package>.failed")
+	bundle := flag.String("bundle", "", "pack all selected voices into a single piper-voices-<bundle> package")
+	dedup := flag.Bool("dedup", false, "move files identical across voices into a shared piper-voices-shared package")
+	platforms := flag.String("platforms", "", "comma-separated GOOS/GOARCH piper binaries to generate, e.g. linux/amd64,darwin/arm64 (default: all)")
+	only := flag.String("only", "", "comma-separated voices and platforms to generate, e.g. jenny,linux")
+	skip := flag.String("skip", "", "comma-separated voices and platforms to skip")
+	voiceBaseURL := flag.String("voice-base-url", "https://huggingface.co/rhasspy/piper-voices/resolve", "base URL of the piper voices repository or a mirror of it")
+	piperBaseURL := flag.String("piper-base-url", "https://github.com/piper-tts-go/piper/releases/download", "base URL of the piper releases or a mirror of them")
+	voiceVersion := flag.String("voice-version", "1.0.0", "tag of the piper voices repository to download voices from")
+	piperVersion := flag.String("piper-version", "v2.0.0", "piper release to download binaries from")
+	tagVersion := flag.String("tag-version", "", "version stamped into generated packages (default: the voice or piper version they're built from)")
+	caCert := flag.String("ca-cert", "", "PEM file of additional CA certificates to trust for downloads")
+	insecure := flag.Bool("insecure", false, "skip TLS certificate verification for downloads")
+	flag.StringVar(&downloader.HFToken, "hf-token", "", "Hugging Face access token for gated voices (default $HF_TOKEN)")
+	flag.StringVar(&downloader.UserAgent, "user-agent", "", "User-Agent header of download requests (default: piper-gen/<version> with a link to the project)")
+	flag.Int64Var(&downloader.MaxSize, "max-download-size", 2<<30, "largest file in bytes to download, or 0 for no limit")
+	minModelSize := flag.Int64("min-model-size", piperpkg.DefaultMinSizes[".onnx"], "smallest voice model in bytes to accept from a download")
+	flag.IntVar(&downloader.MaxConcurrent, "parallel-downloads", 0, "most files to download at once, or 0 for no limit")
+	downloadTimeout := flag.Duration("download-timeout", 30*time.Minute, "time limit for each download, or 0 for no limit")
+	flag.Func("redirect-hosts", "comma-separated hosts downloads may redirect to besides the requested host; empty to disallow cross-host redirects (default: any)", func(s string) error {
+		downloader.RedirectHosts = slices.Sorted(maps.Keys(parseNameList(s)))
+		if downloader.RedirectHosts == nil {
+			downloader.RedirectHosts = []string{}
+		}
+		return nil
+	})
+	flag.BoolVar(&downloader.Offline, "offline", false, "use cached downloads without revalidating them against upstream")
+	flag.StringVar(&builder.ArchiveFormat, "archive-format", "tzst", "format of the embedded archive: tzst or tgz")
+	flag.Func("tar-format", "tar header format of the embedded archive: gnu, pax or ustar (default: the most compatible per entry)", func(s string) error {
+		format, ok := piperpkg.TarFormats[s]
+		if !ok {
+			return fmt.Errorf("unsupported tar format %q", s)
+		}
+		builder.TarFormat = format
+		return nil
+	})
+	flag.StringVar(&builder.ArchiveFilename, "archive-filename", "", "name of the embedded archive in generated packages (default dist.<format>)")
+	flag.StringVar(&builder.MetadataFilename, "metadata-filename", piperpkg.MetadataFilename, "name of the embedded metadata file in generated packages")
+	flag.Func("file-mode", "octal permissions of regular files in archives, e.g. 644 (default: keep the source's)", func(s string) error {
+		mode, err := parseFileMode(s)
+		builder.Perms.File = mode
 		return err
-	}
-	if err := os.WriteFile(filepath.Join(pkgDir, "go.mod"), goMod, 0o644); err != nil {
+	})
+	flag.Func("exec-mode", "octal permissions of executable files in archives, e.g. 755 (default: keep the source's)", func(s string) error {
+		mode, err := parseFileMode(s)
+		builder.Perms.Exec = mode
 		return err
-	}
-	if err := os.WriteFile(filepath.Join(pkgDir, "README.md"), readmeMd, 0o644); err != nil {
+	})
+	flag.Func("license-file", "file whose contents replace the LICENSE of generated packages", func(s string) error {
+		license, err := os.ReadFile(s)
+		builder.License = string(license)
 		return err
+	})
+	flag.Func("copyright", "copyright line of the default LICENSE, e.g. \"2025 Jane Doe\"; may be repeated", func(s string) error {
+		builder.Copyright = append(builder.Copyright, s)
+		return nil
+	})
+	flag.Func("replace", "add a replace directive old=new to the go.mod of generated packages, e.g. "+piperpkg.AssetModulePath+"=../piper-go-asset; may be repeated", func(s string) error {
+		old, replacement, ok := strings.Cut(s, "=")
+		if !ok || old == "" || replacement == "" {
+			return fmt.Errorf("expected old=new, got %q", s)
+		}
+		if builder.Replace == nil {
+			builder.Replace = map[string]string{}
+		}
+		builder.Replace[old] = replacement
+		return nil
+	})
+	flag.BoolVar(&builder.ModelCardSidecar, "model-card-sidecar", false, "embed voice model cards only as MODEL_CARD.txt next to the archive, not inside it")
+	flag.StringVar(&builder.Mode, "mode", piperpkg.ModeEmbed, "embed to embed archives in packages, or lazy to download them from -lazy-url on first use")
+	flag.StringVar(&builder.LazyURL, "lazy-url", "", "base URL lazy packages download their archive from, as <url>/<package>/<version>/<archive>")
+	flag.BoolVar(&builder.StrictCompression, "strict-compression", false, "fail instead of falling back to default compression options when the archive's encoder can't be created")
+	flag.BoolVar(&builder.Manifest, "manifest", false, "end archives with a "+piperpkg.ManifestFilename+" entry listing the size and hash of every file")
+	flag.BoolVar(&builder.VoiceConfigGo, "voice-config-go", false, "write a config.go into voice packages with a Config func returning the parsed voice.json")
+	flag.BoolVar(&builder.CompressModelCard, "compress-model-card", false, "store the MODEL_CARD.txt next to the archive gzipped, with a ModelCard accessor")
+	flag.StringVar(&builder.PhonemizerData, "phonemizer-data", "", "URL or path of espeak-ng data to bundle into voice packages")
+	flag.IntVar(&builder.MajorVersion, "major-version", 0, "major version of generated modules; 2 or more appends /vN to their module path, and any nonzero value must match the package versions (default: unchecked, no suffix)")
+	flag.StringVar(&builder.AssetVersion, "asset-version", "", "version of "+piperpkg.AssetModulePath+" to require in generated packages (default: latest)")
+	voiceNameTemplate := flag.String("voice-name-template", "", "Go template of voice package names, e.g. tts-{{.Language}}-{{.Name}}; fields are as for -layout, with Package the default name (default: piper-voice-<name>-<quality>)")
+	binNameTemplate := flag.String("bin-name-template", "", "Go template of piper binary package names, e.g. piper-{{.OS}}-{{.Arch}}; fields are as for -layout, with Package the default name (default: piper-bin-<platform>)")
+	layout := flag.String("layout", "", "Go template of the directory under -dir of each package, e.g. {{.Kind}}/{{.Language}}/{{.Name}}; fields are Kind, Package, Name, Language, Quality, OS and Arch (default: the package name)")
+	configFilename := flag.String("config", "", "JSON file of options, keyed by flag name; flags given on the command line take precedence")
+	if rebuild {
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
+	if *configFilename != "" {
+		if err := loadConfig(*configFilename); err != nil {
+			log.Fatal().Err(err).Msg("invalid -config")
+		}
 	}
-	if err := os.WriteFile(filepath.Join(pkgDir, "LICENSE"), license, 0o644); err != nil {
-		return err
+	level, err := zerolog.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid -log-level")
+	}
+	zerolog.SetGlobalLevel(level)
+	switch *logFormat {
+	case "console":
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	case "json":
+	default:
+		log.Fatal().Str("format", *logFormat).Msg("invalid -log-format")
+	}
+	if rebuild && flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: piper-gen rebuild [flags] <package directory>...")
+		flag.PrintDefaults()
+		os.Exit(2)
 	}
-	if err := installMeta(pkgDir, version, filepath.Join(pkgDir, ArchiveFilename)); err != nil {
-		return err
+	if *dir == "" && !rebuild {
+		fmt.Fprintln(os.Stderr, "-dir is required.")
+		flag.PrintDefaults()
+		os.Exit(1)
 	}
-	if err := run(pkgDir, "go", "mod", "tidy"); err != nil {
-		return err
+	if *dir != "" {
+		if *dir, err = prepareDir(*dir); err != nil {
+			log.Fatal().Err(err).Msg("invalid -dir")
+		}
+		if !*noLock {
+			unlock, err := piperpkg.LockDir(*dir)
+			if errors.Is(err, piperpkg.ErrLocked) {
+				log.Fatal().Err(err).Msg("another piper-gen run is using -dir; wait for it to finish, or pass -no-lock if runs are isolated otherwise")
+			} else if err != nil {
+				log.Fatal().Err(err).Msg("failed to lock -dir")
+			}
+			defer unlock()
+		}
 	}
-	if err := run(pkgDir, "go", "build", "."); err != nil {
-		return err
+	if downloader.HFToken == "" {
+		downloader.HFToken = os.Getenv("HF_TOKEN")
 	}
-	return nil
-}
-
-func installMeta(dir string, version string, filenames ...string) error {
-	filenames = append([]string(nil), filenames...)
-	sort.Strings(filenames)
-
-	h := xxh3.New()
-	for _, filename := range filenames {
-		if err := hashFile(h, filename); err != nil {
-			return fmt.Errorf("failed to hash file %q: %w", filename, err)
+	if *layout != "" {
+		if builder.Layout, err = piperpkg.ParseLayout(*layout); err != nil {
+			log.Fatal().Err(err).Msg("invalid -layout")
 		}
 	}
-	src, err := json.Marshal(Meta{
-		Version: version,
-		Hash:    h.Sum128(),
-	})
-	if err != nil {
-		return fmt.Errorf("failed to marshal metadata: %w", err)
+	if *voiceNameTemplate != "" {
+		if builder.VoiceName, err = piperpkg.ParseNameTemplate(*voiceNameTemplate); err != nil {
+			log.Fatal().Err(err).Msg("invalid -voice-name-template")
+		}
 	}
-	if err := os.WriteFile(filepath.Join(dir, MetadataFilename), src, 0o644); err != nil {
-		return fmt.Errorf("failed to write metadata: %w", err)
+	if *binNameTemplate != "" {
+		if builder.BinName, err = piperpkg.ParseNameTemplate(*binNameTemplate); err != nil {
+			log.Fatal().Err(err).Msg("invalid -bin-name-template")
+		}
 	}
-	return nil
-}
-
-func copyFile(dest, src string) error {
-	srcFile, err := os.Open(src)
-	if err != nil {
-		return fmt.Errorf("failed to open %q: %w", src, err)
+	if err := builder.Check(); err != nil {
+		log.Fatal().Err(err).Msg("invalid options")
 	}
-	defer srcFile.Close()
-
-	destFile, err := os.Create(dest)
-	if err != nil {
-		return fmt.Errorf("failed to create %q: %w", dest, err)
+	if !builder.SkipBuild {
+		goVersion, err := piperpkg.GoVersion(ctx)
+		if err != nil {
+			log.Fatal().Err(err).Msg("the go toolchain is needed to build generated packages: install it from https://go.dev/dl or pass -skip-build")
+		}
+		log.Info().Str("version", goVersion).Msg("found go toolchain")
 	}
-	_, copyErr := io.Copy(destFile, srcFile)
-	closeErr := destFile.Close()
-	if copyErr != nil {
-		return fmt.Errorf("failed to copy %q to %q: %w", src, dest, copyErr)
+	if rebuild {
+		rebuildPackages(ctx, builder, flag.Args())
+		return
 	}
-	if closeErr != nil {
-		return fmt.Errorf("failed to close %q: %w", dest, closeErr)
+	builder.Dir, downloader.Dir = *dir, *dir
+	// -hf-token is redacted, tokens are best passed in $HF_TOKEN
+	builder.Command = commandArgs(os.Args[1:], map[string]bool{"dir": true, "only": true, "skip": true, "hf-token": true, "restart": true}, pathFlags)
+	if enclosing, err := piperpkg.EnclosingModule(*dir); err != nil {
+		log.Fatal().Err(err).Msg("failed to check output directory")
+	} else if enclosing != "" {
+		log.Warn().Str("dir", *dir).Str("file", enclosing).Msg("output directory is inside an existing Go module or workspace, generated packages are built with GOWORK=off")
 	}
-	return nil
-}
-
-func installVoice(rootDir, name string, version string, urls []string) error {
-	packageName := "piper-voice-" + name
-	packageDirectory := filepath.Join(rootDir, packageName)
-	packagePath := "github.com/piper-tts-go/" + packageName
-
-	archiveFilename := filepath.Join(packageDirectory, ArchiveFilename)
-	tarball, err := newTarball(archiveFilename)
+	client, err := piperpkg.NewHTTPClient(*caCert, *insecure)
 	if err != nil {
-		return fmt.Errorf("failed to create tarball: %w", err)
+		log.Fatal().Err(err).Msg("failed to configure HTTP client")
 	}
-
-	modelFilename := ""
-	for _, url := range urls {
-		basename := filepath.Base(url)
-		extension := filepath.Ext(basename)
-		switch {
-		case basename == "MODEL_CARD":
-		case extension == ".onnx":
-			basename = "voice.onnx"
-		case extension == ".json":
-			basename = "voice.json"
-		default:
-			return fmt.Errorf("encountered unexpected file extension %q", extension)
-		}
-		filename, err := download(rootDir, url)
+	client.Timeout = *downloadTimeout
+	downloader.Client = client
+	if *verifySignatures {
+		if len(checksumsURLs) == 0 || *signingKey == "" {
+			log.Fatal().Msg("-verify-signatures needs -checksums and -signing-key")
+		}
+		src, err := os.ReadFile(*signingKey)
 		if err != nil {
-			return fmt.Errorf("failed to download voice: %w", err)
+			log.Fatal().Err(err).Msg("failed to read -signing-key")
 		}
-		if err := tarball.AppendFile(basename, filename); err != nil {
-			return fmt.Errorf("failed to add %q to tarball: %w", filename, err)
+		key, err := piperpkg.ParsePublicKey(src)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid -signing-key")
 		}
-		if basename == "MODEL_CARD" {
-			modelFilename = filename
+		for _, sumsURL := range checksumsURLs {
+			if err := downloader.LoadSignedChecksums(ctx, sumsURL, sumsURL+".sig", key); err != nil {
+				log.Fatal().Err(err).Str("url", sumsURL).Msg("failed to load signed checksums")
+			}
 		}
+		log.Info().Int("files", len(downloader.Checksums)).Msg("loaded signed checksums")
 	}
-
-	if err := tarball.Close(); err != nil {
-		return fmt.Errorf("failed to close tarball: %w", err)
+	downloader.MinSizes = maps.Clone(piperpkg.DefaultMinSizes)
+	downloader.MinSizes[".onnx"] = *minModelSize
+	if *insecure {
+		log.Warn().Msg("TLS certificate verification is disabled")
 	}
-	if err := copyFile(filepath.Join(packageDirectory, "MODEL_CARD.txt"), modelFilename); err != nil {
-		return fmt.Errorf("failed to copy MODEL_CARD.txt into package: %w", err)
-	}
-	if err := generatePackage(true, packageDirectory, name, packagePath, name, version, "MODEL_CARD.txt"); err != nil {
-		return fmt.Errorf("failed to generate package: %w", err)
-	}
-	return nil
-}
 
-func installPiper(ctx context.Context, rootDir, pkgName, version, url string) (retErr error) {
-	packageName := "piper-bin-" + pkgName
-	packageDirectory := filepath.Join(rootDir, packageName)
-	packagePath := "github.com/piper-tts-go/" + packageName
-	filename, err := download(rootDir, url)
-	if err != nil {
-		return fmt.Errorf("failed to download piper: %w", err)
+	voicePackageVersion, piperPackageVersion := *voiceVersion, *piperVersion
+	if *tagVersion != "" {
+		voicePackageVersion, piperPackageVersion = *tagVersion, *tagVersion
 	}
-	srcFile, err := os.Open(filename)
-	if err != nil {
-		return fmt.Errorf("failed to open %q: %w", filename, err)
+	// packageVersion is the version stamped into a package built from the
+	// source tag pinned by a catalog entry.
+	packageVersion := func(pinned, fallback string) string {
+		if *tagVersion == "" && pinned != "" {
+			return pinned
+		}
+		return fallback
 	}
-	defer srcFile.Close()
 
-	format, stream, err := archiver.Identify(srcFile.Name(), srcFile)
-	if err != nil {
-		return fmt.Errorf("could not identify %q: %w", srcFile.Name(), err)
+	// more voices at https://huggingface.co/rhasspy/piper-voices/tree/v1.0.0
+	voiceCatalog := map[string]catalogVoice{
+		"jenny":   {Language: "en_GB", Dataset: "jenny_dioco", Quality: "medium"},
+		"alan":    {Language: "en_GB", Dataset: "alan", Quality: "medium"},
+		"kristin": {Language: "en_US", Dataset: "kristin", Quality: "medium"},
+		"bryce":   {Language: "en_US", Dataset: "bryce", Quality: "medium"},
+	}
+	releaseCatalog := map[string]catalogRelease{
+		"linux": {
+			OS:          "linux",
+			Arch:        "amd64",
+			Asset:       "piper_linux_x86_64.tar.gz",
+			Paths:       []string{"piper"},
+			StripPrefix: "piper/",
+		},
+		"windows": {
+			OS:          "windows",
+			Arch:        "amd64",
+			Asset:       "piper_windows_amd64.zip",
+			Paths:       []string{"piper"},
+			StripPrefix: "piper/",
+		},
+		"darwin": {
+			OS:          "darwin",
+			Arch:        "arm64",
+			Asset:       "piper_macos_aarch64.tar.gz",
+			Paths:       []string{"piper"},
+			StripPrefix: "piper/",
+		},
 	}
 
-	extractor, ok := format.(archiver.Extractor)
-	if !ok {
-		return fmt.Errorf("%T is not an archiver.Extractor: `%s`", format, srcFile.Name())
+	voices := map[string]piperpkg.VoiceSpec{}
+	for name, entry := range voiceCatalog {
+		sourceVersion := cmp.Or(entry.Version, *voiceVersion)
+		urlPrefix := strings.TrimSuffix(*voiceBaseURL, "/") + "/v" + strings.TrimPrefix(sourceVersion, "v")
+		voice := piperpkg.VoiceSpec{Name: name, Version: packageVersion(entry.Version, voicePackageVersion)}
+		paths := entry.Paths
+		if len(paths) == 0 {
+			paths = piperpkg.VoicePaths(entry.Language, entry.Dataset, entry.Quality)
+		}
+		for _, p := range paths {
+			voice.URLs = append(voice.URLs, catalogSource(urlPrefix, p))
+		}
+		voices[name] = voice
+	}
+	archives := map[string]piperpkg.PiperRelease{}
+	for platform, entry := range releaseCatalog {
+		releasePrefix := strings.TrimSuffix(*piperBaseURL, "/") + "/" + cmp.Or(entry.Version, *piperVersion)
+		archives[platform] = piperpkg.PiperRelease{
+			URL:         catalogSource(releasePrefix, entry.Asset),
+			Version:     packageVersion(entry.Version, piperPackageVersion),
+			Paths:       entry.Paths,
+			StripPrefix: entry.StripPrefix,
+			OS:          entry.OS,
+			Arch:        entry.Arch,
+		}
 	}
 
-	destFilename := filepath.Join(packageDirectory, ArchiveFilename)
-	tarball, err := newTarball(destFilename)
-	if err != nil {
-		return fmt.Errorf("failed to create tarball: %w", err)
-	}
-	err = extractor.Extract(
-		ctx,
-		stream,
-		[]string{"piper"},
-		func(ctx context.Context, f archiver.File) error {
-			fileMode := f.Mode()
-			if !fileMode.IsRegular() && fileMode&os.ModeSymlink == 0 {
-				return nil
-			}
-			reader, err := f.Open()
-			if err != nil {
-				return err
+	if *platforms != "" {
+		selected := map[string]bool{}
+		for target := range parseNameList(*platforms) {
+			goos, goarch, ok := strings.Cut(target, "/")
+			if !ok {
+				log.Fatal().Str("platform", target).Msg("-platforms entries must be GOOS/GOARCH")
 			}
-			defer reader.Close()
-			header := &tar.Header{
-				Name:     strings.TrimPrefix(f.NameInArchive, "piper/"),
-				Mode:     int64(f.Mode()),
-				Size:     f.Size(),
-				Linkname: f.LinkTarget,
+			var available []string
+			for _, name := range slices.Sorted(maps.Keys(releaseCatalog)) {
+				entry := releaseCatalog[name]
+				if entry.OS == goos && entry.Arch == goarch {
+					selected[name] = true
+				}
+				available = append(available, entry.OS+"/"+entry.Arch)
 			}
-			if fileMode&os.ModeSymlink != 0 {
-				header.Typeflag = tar.TypeSymlink
+			if !slices.Contains(available, target) {
+				log.Fatal().Str("platform", target).Strs("available", available).Msg("no piper release for platform")
 			}
-			return tarball.Append(header, reader)
-		},
-	)
-	if e := tarball.Close(); e != nil && err == nil {
-		return fmt.Errorf("failed to close tarball: %w", e)
-	}
-	if err != nil {
-		return fmt.Errorf("failed to extract piper: %w", err)
-	}
-	if err := generatePackage(false, packageDirectory, pkgName, packagePath, pkgName, version); err != nil {
-		return fmt.Errorf("failed to generate package: %w", err)
-	}
-	return nil
-}
-
-func main() {
-	ctx := context.Background()
-	dir := flag.String("dir", "", "root directory to extract store files")
-	flag.Parse()
-	if *dir == "" {
-		fmt.Fprintln(os.Stderr, "-dir is required.")
-		flag.PrintDefaults()
-		os.Exit(1)
+		}
+		maps.DeleteFunc(archives, func(name string, _ piperpkg.PiperRelease) bool { return !selected[name] })
 	}
 
-	// more voices at https://huggingface.co/rhasspy/piper-voices/tree/v1.0.0
-	voiceVersion := "1.0.0"
-	urlPrefix := "https://huggingface.co/rhasspy/piper-voices/resolve/v" + voiceVersion
-	voices := map[string][]string{
-		"jenny": {
-			urlPrefix + "/en/en_GB/jenny_dioco/medium/en_GB-jenny_dioco-medium.onnx",
-			urlPrefix + "/en/en_GB/jenny_dioco/medium/en_GB-jenny_dioco-medium.onnx.json",
-			urlPrefix + "/en/en_GB/jenny_dioco/medium/MODEL_CARD",
-		},
-		"alan": {
-			urlPrefix + "/en/en_GB/alan/medium/en_GB-alan-medium.onnx",
-			urlPrefix + "/en/en_GB/alan/medium/MODEL_CARD",
-			urlPrefix + "/en/en_GB/alan/medium/en_GB-alan-medium.onnx.json",
-		},
-		"kristin": {
-			urlPrefix + "/en/en_US/kristin/medium/en_US-kristin-medium.onnx",
-			urlPrefix + "/en/en_US/kristin/medium/MODEL_CARD",
-			urlPrefix + "/en/en_US/kristin/medium/en_US-kristin-medium.onnx.json",
-		},
-		"bryce": {
-			urlPrefix + "/en/en_US/bryce/medium/en_US-bryce-medium.onnx",
-			urlPrefix + "/en/en_US/bryce/medium/MODEL_CARD",
-			urlPrefix + "/en/en_US/bryce/medium/en_US-bryce-medium.onnx.json",
-		},
+	onlyNames, skipNames := parseNameList(*only), parseNameList(*skip)
+	for name := range onlyNames {
+		if voices[name].Name == "" && archives[name].URL == "" {
+			log.Warn().Str("name", name).Msg("-only names an unknown voice or platform")
+		}
 	}
-	for name, urls := range voices {
-		if err := installVoice(*dir, name, voiceVersion, urls); err != nil {
-			log.Fatal().Err(err).Str("voice", name).Msg("failed to install voice")
+	for name := range skipNames {
+		if voices[name].Name == "" && archives[name].URL == "" {
+			log.Warn().Str("name", name).Msg("-skip names an unknown voice or platform")
 		}
 	}
-
-	piperVersion := "v2.0.0"
-	archives := map[string]string{
-		"linux":   "https://github.com/piper-tts-go/piper/releases/download/" + piperVersion + "/piper_linux_x86_64.tar.gz",
-		"windows": "https://github.com/piper-tts-go/piper/releases/download/" + piperVersion + "/piper_windows_amd64.zip",
-		"darwin":  "https://github.com/piper-tts-go/piper/releases/download/" + piperVersion + "/piper_macos_aarch64.tar.gz",
+	excluded := func(name string) bool {
+		return (len(onlyNames) != 0 && !onlyNames[name]) || skipNames[name]
 	}
-	for plaform, url := range archives {
-		if err := installPiper(ctx, *dir, plaform, piperVersion, url); err != nil {
-			log.Fatal().Err(err).Str("platform", plaform).Msg("failed to install piper")
+	maps.DeleteFunc(voices, func(name string, _ piperpkg.VoiceSpec) bool { return excluded(name) })
+	maps.DeleteFunc(archives, func(name string, _ piperpkg.PiperRelease) bool { return excluded(name) })
+	var skippedUnmodified []string
+	if *since != "" {
+		sinceTime, err := parseSince(*since)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid -since")
 		}
+		unmodified := func(name string, urls ...string) bool {
+			for _, u := range urls {
+				modified, err := downloader.ModifiedSince(ctx, u, sinceTime)
+				if err != nil {
+					log.Warn().Err(err).Str("name", name).Msg("failed to check for upstream changes, generating anyway")
+					return false
+				}
+				if modified {
+					return false
+				}
+			}
+			log.Info().Str("name", name).Str("since", *since).Msg("unchanged upstream, skipping")
+			skippedUnmodified = append(skippedUnmodified, name)
+			return true
+		}
+		if *bundle != "" {
+			// the bundle holds every voice, so it's regenerated if any changed
+			var urls []string
+			for _, voice := range voiceSpecs(voices) {
+				urls = append(urls, voice.URLs...)
+			}
+			if len(voices) != 0 && unmodified(*bundle, urls...) {
+				clear(voices)
+			}
+		} else {
+			maps.DeleteFunc(voices, func(name string, voice piperpkg.VoiceSpec) bool { return unmodified(name, voice.URLs...) })
+		}
+		maps.DeleteFunc(archives, func(name string, release piperpkg.PiperRelease) bool { return unmodified(name, release.URL) })
 	}
-}
-
-type Tarball struct {
-	file    *os.File
-	encoder *zstd.Encoder
-	writer  *tar.Writer
-}
 
-func newTarball(filename string, opts ...zstd.EOption) (*Tarball, error) {
-	if opts == nil {
-		opts = []zstd.EOption{
-			zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+	if *preflight && !downloader.Offline {
+		var urls []string
+		for _, voice := range voices {
+			urls = append(urls, voice.URLs...)
+		}
+		for _, release := range archives {
+			urls = append(urls, release.URL)
+		}
+		log.Info().Int("urls", len(urls)).Msg("checking URLs are reachable")
+		if err := downloader.Preflight(ctx, urls); err != nil {
+			log.Fatal().Err(err).Msg("preflight failed")
 		}
 	}
 
-	os.MkdirAll(filepath.Dir(filename), 0755)
-	file, err := os.Create(filename)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create file %q: %w", filename, err)
+	if *verifySignatures {
+		// every source is checked before any package is generated
+		urls := []string{}
+		for _, voice := range voices {
+			urls = append(urls, voice.URLs...)
+		}
+		for _, release := range archives {
+			urls = append(urls, release.URL)
+		}
+		// local phonemizer data isn't downloaded
+		if strings.HasPrefix(builder.PhonemizerData, "http://") || strings.HasPrefix(builder.PhonemizerData, "https://") {
+			urls = append(urls, builder.PhonemizerData)
+		}
+		slices.Sort(urls)
+		for _, u := range slices.Compact(urls) {
+			if _, err := downloader.Download(ctx, u); err != nil {
+				log.Fatal().Err(err).Str("url", u).Msg("failed to verify download")
+			}
+		}
+		log.Info().Int("files", len(urls)).Msg("verified downloads against signed checksums")
 	}
 
-	encoder, err := zstd.NewWriter(file, opts...)
+	checkpoint, err := piperpkg.LoadCheckpoint(filepath.Join(*dir, ".checkpoint.json"))
 	if err != nil {
-		file.Close()
-		return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+		log.Fatal().Err(err).Msg("failed to load checkpoint")
 	}
-
-	writer := &Tarball{
-		file:    file,
-		encoder: encoder,
-		writer:  tar.NewWriter(encoder),
+	if *restart {
+		if err := checkpoint.Remove(); err != nil {
+			log.Fatal().Err(err).Msg("failed to reset checkpoint")
+		}
+		clear(checkpoint.Packages)
 	}
-	return writer, nil
-}
 
-func (tb *Tarball) Append(h *tar.Header, r io.Reader) error {
-	if err := tb.writer.WriteHeader(h); err != nil {
-		return fmt.Errorf("failed to write header: %w", err)
-	}
-	if _, err := io.Copy(tb.writer, r); err != nil {
-		return fmt.Errorf("failed to copy data: %w", err)
+	report := piperpkg.Report{Skipped: skippedUnmodified}
+	// resumed are the packages completed by a previous run, kept in the
+	// manifest but not reported as generated
+	var resumed []piperpkg.Package
+	completed := func(pkg *piperpkg.Package) {
+		report.Packages = append(report.Packages, *pkg)
+		if err := checkpoint.Record(*pkg); err != nil {
+			log.Warn().Err(err).Msg("failed to update checkpoint")
+		}
 	}
-	if err := tb.writer.Flush(); err != nil {
-		return fmt.Errorf("failed to flush data: %w", err)
+	skipUpToDate := func(loc piperpkg.PackageLocation, version string) bool {
+		packageName, err := builder.PackageName(loc)
+		if err != nil {
+			// reported when generating the package
+			return false
+		}
+		if pkg, ok := builder.Completed(checkpoint, loc, version); ok {
+			log.Info().Str("package", packageName).Str("version", version).Msg("package completed by a previous run, skipping")
+			resumed = append(resumed, pkg)
+			report.Skipped = append(report.Skipped, packageName)
+			return true
+		}
+		if !*update || !builder.UpToDate(loc, version) {
+			return false
+		}
+		log.Info().Str("package", packageName).Str("version", version).Msg("package is up to date, skipping")
+		report.Skipped = append(report.Skipped, packageName)
+		return true
 	}
-	return nil
-}
-
-func (tb *Tarball) AppendFile(dest, src string) error {
-	f, err := os.Open(src)
-	if err != nil {
-		return fmt.Errorf("failed to open %q: %w", src, err)
+	if *bundle != "" && len(voices) != 0 && skipUpToDate(piperpkg.BundleLocation(*bundle), voicePackageVersion) {
+		clear(voices)
 	}
-	defer f.Close()
-
-	info, err := os.Lstat(src)
-	if err != nil {
-		return fmt.Errorf("failed to read file info: %w", err)
+	if *bundle != "" && len(voices) != 0 {
+		pkg, err := builder.InstallVoiceBundle(ctx, *bundle, voicePackageVersion, voiceSpecs(voices))
+		if err != nil {
+			log.Error().Err(err).Str("bundle", *bundle).Msg("failed to install voice bundle")
+			report.Failures = append(report.Failures, piperpkg.Failure{Name: *bundle, Error: err.Error()})
+		} else {
+			completed(pkg)
+		}
+		// the bundle replaces the individual voice packages
+		clear(voices)
 	}
-	header := &tar.Header{
-		Name: dest,
-		Mode: int64(info.Mode()),
-		Size: info.Size(),
+	var shared *piperpkg.SharedPackage
+	if *dedup && len(voices) > 1 {
+		files, err := builder.FindSharedFiles(ctx, voiceSpecs(voices))
+		if err != nil {
+			log.Error().Err(err).Msg("failed to find files shared between voices")
+			report.Failures = append(report.Failures, piperpkg.Failure{Name: "shared", Error: err.Error()})
+		} else if len(files) == 0 {
+			log.Info().Msg("no files shared between voices")
+		} else if completedShared, pkg, ok := builder.CompletedShared(checkpoint, voicePackageVersion, files); ok {
+			log.Info().Str("package", pkg.Name).Str("version", voicePackageVersion).Msg("package completed by a previous run, skipping")
+			shared = completedShared
+			resumed = append(resumed, pkg)
+			report.Skipped = append(report.Skipped, pkg.Name)
+		} else {
+			var pkg *piperpkg.Package
+			shared, pkg, err = builder.InstallShared(ctx, voicePackageVersion, files)
+			if err != nil {
+				log.Error().Err(err).Msg("failed to install shared voice files")
+				report.Failures = append(report.Failures, piperpkg.Failure{Name: "shared", Error: err.Error()})
+			} else {
+				completed(pkg)
+			}
+		}
 	}
-	if info.Mode()&os.ModeSymlink != 0 {
-		nm, err := os.Readlink(src)
+	for name, voice := range voices {
+		if ctx.Err() != nil {
+			break
+		}
+		if skipUpToDate(piperpkg.VoiceLocation(voice), voice.Version) {
+			continue
+		}
+		pkg, err := builder.InstallVoice(ctx, voice, voicePackageVersion, shared)
 		if err != nil {
-			return fmt.Errorf("failed to read symlink: %w", err)
+			log.Error().Err(err).Str("voice", name).Msg("failed to install voice")
+			report.Failures = append(report.Failures, piperpkg.Failure{Name: name, Error: err.Error()})
+			continue
 		}
-		header.Linkname = nm
+		completed(pkg)
 	}
-	if err := tb.Append(header, f); err != nil {
-		return fmt.Errorf("failed to append file %q: %w", src, err)
+
+	for plaform, release := range archives {
+		if ctx.Err() != nil {
+			break
+		}
+		if skipUpToDate(piperpkg.PiperLocation(plaform, release), release.Version) {
+			continue
+		}
+		pkg, err := builder.InstallPiper(ctx, plaform, piperPackageVersion, release)
+		if err != nil {
+			log.Error().Err(err).Str("platform", plaform).Msg("failed to install piper")
+			report.Failures = append(report.Failures, piperpkg.Failure{Name: plaform, Error: err.Error()})
+			continue
+		}
+		completed(pkg)
 	}
-	return nil
-}
 
-func (tb *Tarball) Close() (err error) {
-	if closeErr := tb.writer.Close(); closeErr != nil {
-		err = errors.Join(err, fmt.Errorf("failed to close writer: %w", closeErr))
+	if *update {
+		updated := make([]string, 0, len(report.Packages))
+		for _, pkg := range report.Packages {
+			updated = append(updated, pkg.Name)
+		}
+		log.Info().Strs("updated", updated).Strs("skipped", report.Skipped).Msg("update finished")
+	}
+	if len(report.Packages) != 0 || len(resumed) != 0 {
+		if err := piperpkg.UpdateManifest(filepath.Join(*dir, "manifest.json"), slices.Concat(report.Packages, resumed)); err != nil {
+			log.Error().Err(err).Msg("failed to update manifest")
+		}
+	}
+	if *reportFilename != "" {
+		if err := piperpkg.WriteReport(*reportFilename, report); err != nil {
+			log.Fatal().Err(err).Msg("failed to write report")
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		log.Fatal().Err(err).Msg("generation interrupted")
 	}
-	if closeErr := tb.encoder.Close(); closeErr != nil {
-		err = errors.Join(err, fmt.Errorf("failed to close encoder: %w", closeErr))
+	if len(report.Failures) != 0 {
+		log.Fatal().Int("failures", len(report.Failures)).Msg("failed to generate some packages")
 	}
-	if closeErr := tb.file.Close(); closeErr != nil {
-		err = errors.Join(err, fmt.Errorf("failed to close file: %w", closeErr))
+	if err := checkpoint.Remove(); err != nil {
+		log.Warn().Err(err).Msg("failed to remove checkpoint")
 	}
-	return
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCommandArgs(t *testing.T) {
+	flag.Bool("test-bool", false, "")
+	flag.String("test-value", "", "")
+	flag.String("test-omit", "", "")
+	flag.String("test-path", "", "")
+	flag.String("replace", "", "")
+	omit := map[string]bool{"test-omit": true}
+	paths := map[string]bool{"test-path": true, "replace": true}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs := filepath.Join(wd, "config.json")
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{
+			args: []string{"-test-bool", "-test-value", "v", "-test-omit", "o", "voice"},
+			want: []string{"-test-bool", "-test-value", "v", "voice"},
+		},
+		{
+			args: []string{"-test-omit=o", "--test-value=v"},
+			want: []string{"--test-value=v"},
+		},
+		{
+			// unknown flags are kept as they are
+			args: []string{"-unknown", "-test-omit", "o", "-unknown-value=x", "-test-bool"},
+			want: []string{"-unknown", "-unknown-value=x", "-test-bool"},
+		},
+		{
+			args: []string{"-test-bool", "--", "-test-omit", "o"},
+			want: []string{"-test-bool", "--", "-test-omit", "o"},
+		},
+		{
+			// go:generate runs in the package directory, so relative paths
+			// are made absolute
+			args: []string{"-test-path", "config.json", "--test-path=./config.json", "-test-value", "config.json"},
+			want: []string{"-test-path", abs, "--test-path=" + abs, "-test-value", "config.json"},
+		},
+		{
+			args: []string{"-test-path", abs, "-test-path=https://example.com/config.json"},
+			want: []string{"-test-path", abs, "-test-path=https://example.com/config.json"},
+		},
+		{
+			args: []string{"-replace", "example.com/a=config.json", "-replace=example.com/b=example.com/c@v1.0.0"},
+			want: []string{"-replace", "example.com/a=" + abs, "-replace=example.com/b=example.com/c@v1.0.0"},
+		},
+	}
+	for _, tt := range tests {
+		if got := commandArgs(tt.args, omit, paths); !slices.Equal(got, tt.want) {
+			t.Errorf("commandArgs(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
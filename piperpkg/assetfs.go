@@ -0,0 +1,87 @@
+package piperpkg
+
+import (
+	"errors"
+	"fmt"
+	"go/format"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+func (b *PackageBuilder) assetFSExpr(a packageAsset, fsExpr string) (string, bool) {
+	if b.archiveFilename() == b.defaultArchiveFilename() && b.metadataFilename() == MetadataFilename && a.Dir == "" && a.Base == "" {
+		return fsExpr, false
+	}
+	fields := "fs: " + fsExpr + ", archive: " + strconv.Quote(b.archiveFilename()) + ", metadata: " + strconv.Quote(b.metadataFilename())
+	if a.Dir != "" {
+		fields += ", dir: " + strconv.Quote(a.Dir)
+	}
+	if a.Base != "" {
+		fields += ", base: " + a.Base + ".FS"
+	}
+	return "&assetFS{" + fields + "}", true
+}
+
+func (b *PackageBuilder) writeAssetFS(pkgDir, embedPkgName string, used bool) error {
+	filename := filepath.Join(pkgDir, "assetfs.go")
+	if !used {
+		// left by a previous generation of the package
+		if err := os.Remove(filename); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	src, err := format.Source([]byte(`// GENERATED FILE
+
+package ` + embedPkgName + `
+` + assetFSSource + `
+const (
+	servedArchive  = ` + strconv.Quote(b.defaultArchiveFilename()) + `
+	servedMetadata = ` + strconv.Quote(MetadataFilename) + `
+)
+`))
+	if err != nil {
+		return fmt.Errorf("failed to format assetfs.go: %w", err)
+	}
+	return writeFileAtomic(filename, src, 0o644)
+}
+
+const assetFSSource = `
+import (
+	iofs "io/fs"
+	"path"
+	"strings"
+)
+
+// assetFS serves the files of an asset under the names asset.Asset opens.
+type assetFS struct {
+	fs iofs.FS
+	// archive and metadata are the files of fs served as the archive and
+	// metadata.
+	archive  string
+	metadata string
+	// dir is the directory of fs holding the asset's other files.
+	dir string
+	// base, if not nil, is the FS of the asset holding the files listed in
+	// the Shared field of the metadata, served under shared/.
+	base iofs.FS
+}
+
+func (f *assetFS) Open(name string) (iofs.File, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: iofs.ErrInvalid}
+	}
+	switch {
+	case name == servedArchive:
+		name = f.archive
+	case name == servedMetadata:
+		name = f.metadata
+	case f.base != nil && strings.HasPrefix(name, "shared/"):
+		return f.base.Open(strings.TrimPrefix(name, "shared/"))
+	default:
+		name = path.Join(f.dir, name)
+	}
+	return f.fs.Open(name)
+}
+`
@@ -0,0 +1,240 @@
+package piperpkg
+
+import (
+	"context"
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testVoices returns two fake voices, alpha and beta, whose model cards and
+// configs are identical, and the files serving them.
+func testVoices(t *testing.T) (map[string][]byte, func(s *fixtureServer) []VoiceSpec) {
+	t.Helper()
+	files := map[string][]byte{}
+	names := []string{"alpha", "beta"}
+	for i, name := range names {
+		onnx := testONNX()
+		onnx[1] = byte(i)
+		files["/"+name+"/en_GB-"+name+"-low.onnx"] = onnx
+		files["/"+name+"/en_GB-"+name+"-low.onnx.json"] = []byte(testVoiceJSON)
+		files["/"+name+"/MODEL_CARD"] = []byte(testModelCard)
+	}
+	return files, func(s *fixtureServer) []VoiceSpec {
+		var voices []VoiceSpec
+		for _, name := range names {
+			voices = append(voices, VoiceSpec{Name: name, URLs: []string{
+				s.URL + "/" + name + "/en_GB-" + name + "-low.onnx",
+				s.URL + "/" + name + "/en_GB-" + name + "-low.onnx.json",
+				s.URL + "/" + name + "/MODEL_CARD",
+			}})
+		}
+		return voices
+	}
+}
+
+// assetKeys returns the keys of every asset.Asset literal in the embed.go
+// of pkgDir.
+func assetKeys(t *testing.T, pkgDir string) [][]string {
+	t.Helper()
+	file, err := parser.ParseFile(token.NewFileSet(), filepath.Join(pkgDir, "embed.go"), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys [][]string
+	ast.Inspect(file, func(n ast.Node) bool {
+		lit, ok := n.(*ast.CompositeLit)
+		if !ok {
+			return true
+		}
+		sel, ok := lit.Type.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "Asset" {
+			return true
+		}
+		var litKeys []string
+		for _, elt := range lit.Elts {
+			litKeys = append(litKeys, elt.(*ast.KeyValueExpr).Key.(*ast.Ident).Name)
+		}
+		keys = append(keys, litKeys)
+		return true
+	})
+	return keys
+}
+
+func TestAssetLiteralFields(t *testing.T) {
+	tests := []struct {
+		name string
+		// install generates the package and returns its directory.
+		install func(t *testing.T, b *PackageBuilder, voices []VoiceSpec) string
+		want    []packageAsset
+		assetFS bool
+		// served is the name assetFS serves the archive as, if checked.
+		served string
+	}{
+		{
+			name: "default",
+			install: func(t *testing.T, b *PackageBuilder, voices []VoiceSpec) string {
+				if _, err := b.InstallVoice(context.Background(), voices[0], "v1.0.0", nil); err != nil {
+					t.Fatal(err)
+				}
+				return filepath.Join(b.Dir, "piper-voice-alpha-low")
+			},
+			want: []packageAsset{{Var: "Asset", Name: "alpha"}},
+		},
+		{
+			name: "archive name",
+			install: func(t *testing.T, b *PackageBuilder, voices []VoiceSpec) string {
+				b.ArchiveFilename = "voice.tzst"
+				b.MetadataFilename = "voice.json"
+				if _, err := b.InstallVoice(context.Background(), voices[0], "v1.0.0", nil); err != nil {
+					t.Fatal(err)
+				}
+				return filepath.Join(b.Dir, "piper-voice-alpha-low")
+			},
+			want:    []packageAsset{{Var: "Asset", Name: "alpha"}},
+			assetFS: true,
+			served:  "dist.tzst",
+		},
+		{
+			name: "gzip",
+			install: func(t *testing.T, b *PackageBuilder, voices []VoiceSpec) string {
+				b.ArchiveFormat = "tgz"
+				if _, err := b.InstallVoice(context.Background(), voices[0], "v1.0.0", nil); err != nil {
+					t.Fatal(err)
+				}
+				return filepath.Join(b.Dir, "piper-voice-alpha-low")
+			},
+			want: []packageAsset{{Var: "Asset", Name: "alpha"}},
+		},
+		{
+			name: "gzip archive name",
+			install: func(t *testing.T, b *PackageBuilder, voices []VoiceSpec) string {
+				b.ArchiveFormat = "tgz"
+				b.ArchiveFilename = "voice.tgz"
+				if _, err := b.InstallVoice(context.Background(), voices[0], "v1.0.0", nil); err != nil {
+					t.Fatal(err)
+				}
+				return filepath.Join(b.Dir, "piper-voice-alpha-low")
+			},
+			want:    []packageAsset{{Var: "Asset", Name: "alpha"}},
+			assetFS: true,
+			served:  "dist.tgz",
+		},
+		{
+			name: "bundle",
+			install: func(t *testing.T, b *PackageBuilder, voices []VoiceSpec) string {
+				if _, err := b.InstallVoiceBundle(context.Background(), "test", "v1.0.0", voices); err != nil {
+					t.Fatal(err)
+				}
+				return filepath.Join(b.Dir, "piper-voices-test")
+			},
+			want: []packageAsset{
+				{Var: "Alpha", Name: "alpha", Dir: "alpha"},
+				{Var: "Beta", Name: "beta", Dir: "beta"},
+			},
+			assetFS: true,
+		},
+		{
+			name: "shared",
+			install: func(t *testing.T, b *PackageBuilder, voices []VoiceSpec) string {
+				ctx := context.Background()
+				files, err := b.FindSharedFiles(ctx, voices)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(files) != 2 {
+					t.Fatalf("found %d shared files, want 2", len(files))
+				}
+				shared, _, err := b.InstallShared(ctx, "v1.0.0", files)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if keys := assetKeys(t, shared.Dir); !slices.EqualFunc(keys, [][]string{{"Name", "FS"}}, slices.Equal) {
+					t.Errorf("shared package declares assets with keys %q", keys)
+				}
+				if _, err := b.InstallVoice(ctx, voices[0], "v1.0.0", shared); err != nil {
+					t.Fatal(err)
+				}
+				return filepath.Join(b.Dir, "piper-voice-alpha-low")
+			},
+			want:    []packageAsset{{Var: "Asset", Name: "alpha", Base: "piper_voices_shared.Asset"}},
+			assetFS: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, voices := testVoices(t)
+			s := newFixtureServer(t, files)
+			b := newTestBuilder(t, s)
+			pkgDir := tt.install(t, b, voices(s))
+
+			for _, keys := range assetKeys(t, pkgDir) {
+				if !slices.Equal(keys, []string{"Name", "FS"}) {
+					t.Errorf("asset literal has keys %q, want Name and FS", keys)
+				}
+			}
+			_, err := os.Stat(filepath.Join(pkgDir, "assetfs.go"))
+			if exists := err == nil; exists != tt.assetFS {
+				t.Errorf("assetfs.go exists: %v, want %v", exists, tt.assetFS)
+			} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+				t.Fatal(err)
+			}
+			if tt.assetFS {
+				checkAssetFS(t, pkgDir, tt.served)
+			}
+			// rebuilding reads the assets back from embed.go
+			embedGo, err := readEmbedGo(pkgDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(embedGo.assets, tt.want) {
+				t.Errorf("embed.go declares assets %+v, want %+v", embedGo.assets, tt.want)
+			}
+		})
+	}
+}
+
+// checkAssetFS checks that the assetfs.go of pkgDir only imports the
+// standard library, and serves the archive as served if not empty.
+func checkAssetFS(t *testing.T, pkgDir, served string) {
+	t.Helper()
+	file, err := parser.ParseFile(token.NewFileSet(), filepath.Join(pkgDir, "assetfs.go"), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, spec := range file.Imports {
+		importPath, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first, _, _ := strings.Cut(importPath, "/"); strings.Contains(first, ".") {
+			t.Errorf("assetfs.go imports %s", importPath)
+		}
+	}
+	if served == "" {
+		return
+	}
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			value := spec.(*ast.ValueSpec)
+			if value.Names[0].Name == "servedArchive" {
+				if got, err := stringLit("servedArchive", value.Values[0]); err != nil || got != served {
+					t.Errorf("assetfs.go serves the archive as %q (%v), want %q", got, err, served)
+				}
+				return
+			}
+		}
+	}
+	t.Error("assetfs.go doesn't declare servedArchive")
+}
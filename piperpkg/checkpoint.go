@@ -0,0 +1,101 @@
+package piperpkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// Checkpoint records the packages completed by a generation run, so that an
+// interrupted run can resume without regenerating them.
+type Checkpoint struct {
+	filename string
+	Packages map[string]Package
+}
+
+// LoadCheckpoint reads the checkpoint in filename, or returns an empty one
+// if it doesn't exist.
+func LoadCheckpoint(filename string) (*Checkpoint, error) {
+	c := &Checkpoint{filename: filename, Packages: map[string]Package{}}
+	src, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	if err := json.Unmarshal(src, c); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint %q: %w", filename, err)
+	}
+	if c.Packages == nil {
+		c.Packages = map[string]Package{}
+	}
+	return c, nil
+}
+
+// Record adds pkg to the checkpoint and saves it.
+func (c *Checkpoint) Record(pkg Package) error {
+	c.Packages[pkg.Name] = pkg
+	src, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to marshal checkpoint: %w", err)
+	}
+	if err := writeFileAtomic(c.filename, src, 0o644); err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+	return nil
+}
+
+// Remove deletes the checkpoint file.
+func (c *Checkpoint) Remove() error {
+	if err := os.Remove(c.filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove checkpoint: %w", err)
+	}
+	return nil
+}
+
+// Completed returns the package at loc recorded in c if it was generated at
+// version and is still in place unmodified.
+func (b *PackageBuilder) Completed(c *Checkpoint, loc PackageLocation, version string) (Package, bool) {
+	name, err := b.PackageName(loc)
+	if err != nil {
+		return Package{}, false
+	}
+	pkg, ok := c.Packages[name]
+	if !ok || pkg.Version != version {
+		return Package{}, false
+	}
+	pkgDir, err := b.PackageDir(loc)
+	if err != nil {
+		return Package{}, false
+	}
+	meta, ok := b.existingMeta(pkgDir)
+	if !ok || meta.Version != version || meta.Hash != pkg.ContentHash {
+		return Package{}, false
+	}
+	return pkg, true
+}
+
+// CompletedShared returns the shared package recorded in c if it was
+// generated at version from exactly files and is still in place unmodified.
+func (b *PackageBuilder) CompletedShared(c *Checkpoint, version string, files map[Hash]string) (*SharedPackage, Package, bool) {
+	pkg, ok := b.Completed(c, SharedLocation, version)
+	if !ok {
+		return nil, Package{}, false
+	}
+	shared, err := b.sharedPackage(version, files)
+	if err != nil {
+		return nil, Package{}, false
+	}
+	meta, ok := b.existingMeta(shared.Dir)
+	if !ok || len(meta.Files) != len(files) {
+		return nil, Package{}, false
+	}
+	for h := range files {
+		if _, ok := meta.Files[h.String()]; !ok {
+			return nil, Package{}, false
+		}
+	}
+	return shared, pkg, true
+}
@@ -0,0 +1,181 @@
+package piperpkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrVerification is wrapped by errors of files failing verification against
+// signed checksums.
+var ErrVerification = errors.New("verification failed")
+
+// Checksums maps the URLs, or absolute paths of local files, listed in
+// checksums files to their SHA-256 digest.
+type Checksums map[string][sha256.Size]byte
+
+// ParsePublicKey parses an ed25519 public key, base64 encoded either as is or
+// in the format of signify, which is used for the signatures of checksums
+// files too.
+func ParsePublicKey(src []byte) (ed25519.PublicKey, error) {
+	key, err := decodeSignify(src, ed25519.PublicKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+func decodeSignify(src []byte, size int) ([]byte, error) {
+	var encoded string
+	for _, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "untrusted comment:") {
+			encoded = line
+			break
+		}
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == size+10 && string(data[:2]) == "Ed" {
+		data = data[10:]
+	}
+	if len(data) != size {
+		return nil, fmt.Errorf("expected %d bytes, got %d", size, len(data))
+	}
+	return data, nil
+}
+
+// LoadSignedChecksums downloads the checksums file sumsURL and its detached
+// signature sigURL, checks the signature with key and adds the checksums to
+// d.Checksums, so every file Download returns must match one. Entries are in
+// the format of sha256sum or signify, naming files relative to sumsURL.
+func (d *Downloader) LoadSignedChecksums(ctx context.Context, sumsURL, sigURL string, key ed25519.PublicKey) error {
+	sumsFilename, err := d.download(ctx, sumsURL)
+	if err != nil {
+		return fmt.Errorf("failed to download checksums: %w", err)
+	}
+	sigFilename, err := d.download(ctx, sigURL)
+	if err != nil {
+		return fmt.Errorf("failed to download signature: %w", err)
+	}
+	sums, err := os.ReadFile(sumsFilename)
+	if err != nil {
+		return fmt.Errorf("failed to read checksums: %w", err)
+	}
+	sigSrc, err := os.ReadFile(sigFilename)
+	if err != nil {
+		return fmt.Errorf("failed to read signature: %w", err)
+	}
+	sig, err := decodeSignify(sigSrc, ed25519.SignatureSize)
+	if err != nil {
+		return fmt.Errorf("invalid signature %s: %w", sigURL, err)
+	}
+	if !ed25519.Verify(key, sums, sig) {
+		return fmt.Errorf("%w: bad signature of %s", ErrVerification, sumsURL)
+	}
+
+	if d.Checksums == nil {
+		d.Checksums = Checksums{}
+	}
+	for i, line := range strings.Split(string(sums), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		name, digest, err := parseChecksumLine(line)
+		if err != nil {
+			return fmt.Errorf("invalid line %d of %s: %w", i+1, sumsURL, err)
+		}
+		key, err := checksumKey(sumsURL, name)
+		if err != nil {
+			return fmt.Errorf("invalid line %d of %s: %w", i+1, sumsURL, err)
+		}
+		if prev, ok := d.Checksums[key]; ok && prev != digest {
+			return fmt.Errorf("%w: conflicting checksums of %s", ErrVerification, key)
+		}
+		d.Checksums[key] = digest
+	}
+	return nil
+}
+
+func parseChecksumLine(line string) (string, [sha256.Size]byte, error) {
+	var digest [sha256.Size]byte
+	var name, encoded string
+	if rest, ok := strings.CutPrefix(line, "SHA256 ("); ok {
+		var found bool
+		name, encoded, found = strings.Cut(rest, ") = ")
+		if !found {
+			return "", digest, errors.New("missing digest")
+		}
+	} else {
+		var found bool
+		encoded, name, found = strings.Cut(line, " ")
+		if !found {
+			return "", digest, errors.New("missing file name")
+		}
+		name = strings.TrimPrefix(strings.TrimPrefix(name, " "), "*")
+	}
+	data, err := hex.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(data) != sha256.Size {
+		return "", digest, fmt.Errorf("invalid SHA-256 digest %q", encoded)
+	}
+	copy(digest[:], data)
+	return strings.TrimSpace(name), digest, nil
+}
+
+func checksumKey(sumsURL, name string) (string, error) {
+	if filename, ok := localPath(sumsURL); ok {
+		return filepath.Abs(filepath.Join(filepath.Dir(filename), filepath.FromSlash(name)))
+	}
+	base, err := url.Parse(sumsURL)
+	if err != nil {
+		return "", err
+	}
+	// names are paths, which may contain characters special in URLs
+	ref, err := url.Parse((&url.URL{Path: name}).EscapedPath())
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+func (d *Downloader) verifyChecksum(srcURL, filename string) error {
+	key := srcURL
+	if local, ok := localPath(srcURL); ok {
+		abs, err := filepath.Abs(local)
+		if err != nil {
+			return err
+		}
+		key = abs
+	} else if u, err := url.Parse(srcURL); err == nil {
+		key = u.String()
+	}
+	want, ok := d.Checksums[key]
+	if !ok {
+		return fmt.Errorf("%w: %s is not listed in any signed checksums file", ErrVerification, srcURL)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %w", filename, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("failed to hash %q: %w", filename, err)
+	}
+	if got := h.Sum(nil); !bytes.Equal(got, want[:]) {
+		return fmt.Errorf("%w: SHA-256 of %s is %x, signed checksum is %x", ErrVerification, srcURL, got, want)
+	}
+	return nil
+}
@@ -0,0 +1,570 @@
+package piperpkg
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/zeebo/xxh3"
+)
+
+// Downloader fetches files into a download cache, revalidating cached files
+// against upstream.
+type Downloader struct {
+	// Dir is the directory holding the piper-gen.cache download cache.
+	Dir string
+	// Client sends the requests, or http.DefaultClient if nil.
+	Client *http.Client
+	// Offline makes Download use cached files without revalidating them and
+	// fail for files that aren't cached.
+	Offline bool
+	// HFToken, if set, is sent as a bearer token to huggingface.co for
+	// gated and private repositories.
+	HFToken string
+	// UserAgent is the User-Agent header of every request, or
+	// DefaultUserAgent if empty.
+	UserAgent string
+	// MaxSize, if positive, is the largest file in bytes Download accepts.
+	MaxSize int64
+	// RedirectHosts, if not nil, limits redirects to other hosts than the
+	// one requested to these hosts and their subdomains. An empty list
+	// disallows cross-host redirects.
+	RedirectHosts []string
+	// MinSizes maps URL path extensions, e.g. ".onnx", to the smallest file
+	// in bytes Download accepts, with "" as the default for other files.
+	// DefaultMinSizes is used when nil.
+	MinSizes map[string]int64
+
+	// MaxConcurrent, if positive, caps the number of files fetched at once;
+	// further downloads wait for one to finish.
+	MaxConcurrent int
+
+	// Checksums, if not nil, must list every file Download returns with
+	// its SHA-256 digest. See LoadSignedChecksums.
+	Checksums Checksums
+
+	mu       sync.Mutex
+	inflight map[string]*downloadCall
+	slots    chan struct{}
+}
+
+// DefaultUserAgent returns the User-Agent identifying requests from this
+// version of piper-gen.
+func DefaultUserAgent() string {
+	return "piper-gen/" + ToolVersion() + " (+https://github.com/piper-tts-go/piper-gen)"
+}
+
+// DefaultMinSizes rejects empty downloads and voice models too small to be
+// real: a few MB is less than any piper model, but more than the error pages
+// served in place of one.
+var DefaultMinSizes = map[string]int64{
+	"":      1,
+	".onnx": 5 << 20,
+}
+
+func (d *Downloader) minSize(srcURL string) int64 {
+	sizes := d.MinSizes
+	if sizes == nil {
+		sizes = DefaultMinSizes
+	}
+	ext := path.Ext(srcURL)
+	if u, err := url.Parse(srcURL); err == nil {
+		ext = path.Ext(u.Path)
+	}
+	if size, ok := sizes[ext]; ok {
+		return size
+	}
+	return sizes[""]
+}
+
+type downloadCall struct {
+	done     chan struct{}
+	filename string
+	err      error
+}
+
+type cacheEntry struct {
+	URL string
+	// ResolvedURL is where URL redirected to, if anywhere.
+	ResolvedURL string `json:",omitempty"`
+	// Hash is the hash of the file, computed while downloading it.
+	Hash         *Hash  `json:",omitempty"`
+	ETag         string `json:",omitempty"`
+	LastModified string `json:",omitempty"`
+}
+
+func cacheFilename(rootDir string, srcURL string) string {
+	basename := path.Base(srcURL)
+	if u, err := url.Parse(srcURL); err == nil {
+		basename = path.Base(u.Path)
+	}
+	if len(basename) > 100 {
+		basename = basename[:100]
+	}
+	return filepath.Join(
+		rootDir,
+		"piper-gen.cache",
+		fmt.Sprintf("%016x-%s", xxh3.HashString(srcURL), basename),
+	)
+}
+
+func migrateCacheEntry(rootDir string, srcURL string, filename string) {
+	legacyFilename := filepath.Join(rootDir, "piper-gen.cache", url.QueryEscape(srcURL))
+	if _, err := os.Stat(legacyFilename); err != nil {
+		return
+	}
+	if err := os.Rename(legacyFilename, filename); err != nil {
+		log.Warn().Err(err).Str("url", srcURL).Msg("failed to migrate cache entry")
+		return
+	}
+	if err := writeCacheEntry(filename, cacheEntry{URL: srcURL}); err != nil {
+		log.Warn().Err(err).Str("url", srcURL).Msg("failed to write cache entry")
+	}
+}
+
+func readCacheEntry(filename string) (cacheEntry, error) {
+	var entry cacheEntry
+	src, err := os.ReadFile(filename + ".meta")
+	if err != nil {
+		return entry, err
+	}
+	err = json.Unmarshal(src, &entry)
+	return entry, err
+}
+
+func writeCacheEntry(filename string, entry cacheEntry) error {
+	src, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename+".meta", src, 0o644)
+}
+
+func (d *Downloader) client() http.Client {
+	client := *cmp.Or(d.Client, http.DefaultClient)
+	client.CheckRedirect = d.checkRedirect
+	return client
+}
+
+// NewHTTPClient returns a client that honors the proxy environment variables
+// and additionally trusts the PEM certificates in caCertFilename, if set.
+func NewHTTPClient(caCertFilename string, insecure bool) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if caCertFilename != "" {
+		pem, err := os.ReadFile(caCertFilename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificates: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", caCertFilename)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// Download returns the filename of srcURL in the download cache, fetching or
+// revalidating it first unless d.Offline is set. It's safe for concurrent use:
+// concurrent calls for the same URL share a single download.
+func (d *Downloader) Download(ctx context.Context, srcURL string) (string, error) {
+	key := cacheFilename(d.Dir, srcURL)
+	d.mu.Lock()
+	if call, ok := d.inflight[key]; ok {
+		d.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.filename, call.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	if d.inflight == nil {
+		d.inflight = map[string]*downloadCall{}
+	}
+	call := &downloadCall{done: make(chan struct{})}
+	d.inflight[key] = call
+	d.mu.Unlock()
+
+	call.filename, call.err = d.download(ctx, srcURL)
+	if call.err == nil && d.Checksums != nil {
+		if call.err = d.verifyChecksum(srcURL, call.filename); call.err != nil {
+			call.filename = ""
+		}
+	}
+	d.mu.Lock()
+	delete(d.inflight, key)
+	d.mu.Unlock()
+	close(call.done)
+	return call.filename, call.err
+}
+
+func localPath(srcURL string) (string, bool) {
+	if !strings.Contains(srcURL, "://") {
+		return srcURL, true
+	}
+	if u, err := url.Parse(srcURL); err == nil && u.Scheme == "file" {
+		return filepath.FromSlash(u.Path), true
+	}
+	return "", false
+}
+
+func (d *Downloader) local(srcURL, filename string) (string, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to read local file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("local file %q is not a regular file", filename)
+	}
+	if minSize := d.minSize(srcURL); info.Size() < minSize {
+		return "", fmt.Errorf("local file %q is only %d bytes, expected at least %d", filename, info.Size(), minSize)
+	}
+	log.Debug().Str("filename", filename).Msg("using local file")
+	return filepath.Abs(filename)
+}
+
+func (d *Downloader) download(ctx context.Context, srcURL string) (string, error) {
+	if filename, ok := localPath(srcURL); ok {
+		return d.local(srcURL, filename)
+	}
+	log.Info().Str("url", srcURL).Msg("downloading file")
+	filename := cacheFilename(d.Dir, srcURL)
+	os.MkdirAll(filepath.Dir(filename), 0o755)
+	migrateCacheEntry(d.Dir, srcURL, filename)
+
+	var entry cacheEntry
+	if info, err := os.Stat(filename); err == nil && info.Size() < d.minSize(srcURL) {
+		log.Warn().Str("url", srcURL).Int64("size", info.Size()).Msg("cached file is too small, discarding it")
+		if err := d.Evict(srcURL); err != nil {
+			return "", err
+		}
+	}
+	if _, err := os.Stat(filename); err == nil {
+		if d.Offline {
+			log.Debug().Str("url", srcURL).Str("filename", filename).Msg("using cached file")
+			return filename, nil
+		}
+		entry, err = readCacheEntry(filename)
+		if err != nil || (entry.ETag == "" && entry.LastModified == "") {
+			// nothing to revalidate against, so trust the cache as before
+			log.Debug().Str("url", srcURL).Str("filename", filename).Msg("using cached file")
+			return filename, nil
+		}
+		log.Debug().Str("url", srcURL).Str("etag", entry.ETag).Str("last_modified", entry.LastModified).Msg("revalidating cached file")
+	} else if d.Offline {
+		return "", fmt.Errorf("%q is not cached and downloads are disabled", srcURL)
+	}
+
+	release, err := d.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	err = d.fetch(ctx, srcURL, filename, entry)
+	release()
+	if err != nil {
+		if entry.URL == "" || ctx.Err() != nil {
+			return "", fmt.Errorf("failed to download %q: %w", srcURL, err)
+		}
+		log.Warn().Err(err).Str("url", srcURL).Msg("failed to revalidate cached file, using it anyway")
+	}
+	return filename, nil
+}
+
+func (d *Downloader) acquire(ctx context.Context) (func(), error) {
+	if d.MaxConcurrent <= 0 {
+		return func() {}, nil
+	}
+	d.mu.Lock()
+	if d.slots == nil {
+		d.slots = make(chan struct{}, d.MaxConcurrent)
+	}
+	slots := d.slots
+	d.mu.Unlock()
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func isHuggingFace(u *url.URL) bool {
+	host := u.Hostname()
+	return host == "huggingface.co" || strings.HasSuffix(host, ".huggingface.co")
+}
+
+func (d *Downloader) checkRedirect(request *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	host := request.URL.Hostname()
+	if d.RedirectHosts == nil || host == via[0].URL.Hostname() {
+		return nil
+	}
+	for _, allowed := range d.RedirectHosts {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("redirect to %s is not allowed", host)
+}
+
+// Evict removes srcURL from the download cache.
+func (d *Downloader) Evict(srcURL string) error {
+	filename := cacheFilename(d.Dir, srcURL)
+	for _, name := range []string{filename, filename + ".meta"} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to evict %q from the cache: %w", srcURL, err)
+		}
+	}
+	return nil
+}
+
+// Hash returns the hash of the cached download of srcURL, as recorded when
+// it was downloaded or else computed from the file.
+func (d *Downloader) Hash(srcURL string) (Hash, error) {
+	if filename, ok := localPath(srcURL); ok {
+		return fileHash(filename)
+	}
+	filename := cacheFilename(d.Dir, srcURL)
+	if entry, err := readCacheEntry(filename); err == nil && entry.Hash != nil {
+		return *entry.Hash, nil
+	}
+	return fileHash(filename)
+}
+
+var errCorruptDownload = errors.New("corrupt download")
+
+func (d *Downloader) verifyCached(srcURL string) error {
+	if _, ok := localPath(srcURL); ok {
+		return nil
+	}
+	filename := cacheFilename(d.Dir, srcURL)
+	entry, err := readCacheEntry(filename)
+	if err != nil || entry.Hash == nil {
+		return nil
+	}
+	h, err := fileHash(filename)
+	if err != nil {
+		return err
+	}
+	if h != *entry.Hash {
+		return fmt.Errorf("%w: cached %q has hash %s, expected %s", errCorruptDownload, srcURL, h, *entry.Hash)
+	}
+	return nil
+}
+
+// ResolvedURLs maps those of urls that were redirected when downloaded to
+// the URL they resolved to.
+func (d *Downloader) ResolvedURLs(urls []string) map[string]string {
+	resolved := map[string]string{}
+	for _, u := range urls {
+		entry, err := readCacheEntry(cacheFilename(d.Dir, u))
+		if err == nil && entry.ResolvedURL != "" {
+			resolved[u] = entry.ResolvedURL
+		}
+	}
+	if len(resolved) == 0 {
+		return nil
+	}
+	return resolved
+}
+
+func (d *Downloader) setHeaders(request *http.Request) {
+	request.Header.Set("User-Agent", cmp.Or(d.UserAgent, DefaultUserAgent()))
+	if d.HFToken != "" && isHuggingFace(request.URL) {
+		request.Header.Set("Authorization", "Bearer "+d.HFToken)
+	}
+}
+
+func (d *Downloader) head(ctx context.Context, srcURL string, header http.Header) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodHead, srcURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	d.setHeaders(request)
+	client := d.client()
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	return response, nil
+}
+
+// Preflight checks with HEAD requests that every URL in urls is reachable,
+// returning an error listing all that aren't.
+func (d *Downloader) Preflight(ctx context.Context, urls []string) error {
+	var (
+		mu   sync.Mutex
+		errs []error
+		wg   sync.WaitGroup
+	)
+	slots := make(chan struct{}, cmp.Or(d.MaxConcurrent, 8))
+	for _, srcURL := range slices.Sorted(slices.Values(urls)) {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer func() { <-slots; wg.Done() }()
+			var err error
+			if filename, ok := localPath(srcURL); ok {
+				_, err = d.local(srcURL, filename)
+			} else {
+				var response *http.Response
+				response, err = d.head(ctx, srcURL, nil)
+				if err == nil && (response.StatusCode < 200 || response.StatusCode > 299) {
+					err = fmt.Errorf("unexpected status %s", response.Status)
+				}
+			}
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", srcURL, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return errors.Join(errs...)
+}
+
+// ModifiedSince reports whether the file at srcURL changed upstream after
+// since, asking with a HEAD request, or from the cached Last-Modified when
+// offline. Files without a known modification time count as modified.
+func (d *Downloader) ModifiedSince(ctx context.Context, srcURL string, since time.Time) (bool, error) {
+	if filename, ok := localPath(srcURL); ok {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return false, fmt.Errorf("failed to check %q: %w", filename, err)
+		}
+		return info.ModTime().After(since), nil
+	}
+	lastModified := ""
+	if d.Offline {
+		entry, err := readCacheEntry(cacheFilename(d.Dir, srcURL))
+		if err != nil {
+			return true, nil
+		}
+		lastModified = entry.LastModified
+	} else {
+		response, err := d.head(ctx, srcURL, http.Header{"If-Modified-Since": {since.UTC().Format(http.TimeFormat)}})
+		if err != nil {
+			return false, fmt.Errorf("failed to check %q: %w", srcURL, err)
+		}
+		if response.StatusCode == http.StatusNotModified {
+			return false, nil
+		}
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			return false, fmt.Errorf("failed to check %q: unexpected status %s", srcURL, response.Status)
+		}
+		lastModified = response.Header.Get("Last-Modified")
+	}
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		return true, nil
+	}
+	return modified.After(since), nil
+}
+
+func (d *Downloader) fetch(ctx context.Context, srcURL string, filename string, entry cacheEntry) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, srcURL, nil)
+	if err != nil {
+		return err
+	}
+	d.setHeaders(request)
+	if entry.ETag != "" {
+		request.Header.Set("If-None-Match", entry.ETag)
+	}
+	if entry.LastModified != "" {
+		request.Header.Set("If-Modified-Since", entry.LastModified)
+	}
+	client := d.client()
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	resolvedURL := response.Request.URL.String()
+	if resolvedURL == srcURL {
+		resolvedURL = ""
+	} else {
+		log.Debug().Str("url", srcURL).Str("resolved_url", resolvedURL).Msg("followed redirect")
+	}
+
+	if response.StatusCode == http.StatusNotModified {
+		log.Debug().Str("url", srcURL).Msg("cached file is up to date")
+		return nil
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+	if d.MaxSize > 0 && response.ContentLength > d.MaxSize {
+		return fmt.Errorf("file is %d bytes, larger than the maximum of %d", response.ContentLength, d.MaxSize)
+	}
+	if entry.URL != "" {
+		log.Info().Str("url", srcURL).Msg("upstream file changed, replacing cached file")
+	}
+
+	// download next to the cache entry so a failure never clobbers it
+	out, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	body := io.Reader(response.Body)
+	if d.MaxSize > 0 {
+		body = io.LimitReader(body, d.MaxSize+1)
+	}
+	hasher := xxh3.New()
+	n, copyErr := io.Copy(io.MultiWriter(out, hasher), body)
+	closeErr := out.Close()
+	if copyErr != nil {
+		return copyErr
+	}
+	if d.MaxSize > 0 && n > d.MaxSize {
+		return fmt.Errorf("file exceeds the maximum download size of %d bytes", d.MaxSize)
+	}
+	if minSize := d.minSize(srcURL); n < minSize {
+		return fmt.Errorf("received only %d bytes, expected at least %d", n, minSize)
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	if err := os.Rename(out.Name(), filename); err != nil {
+		return err
+	}
+	hash := Hash(hasher.Sum128())
+	return writeCacheEntry(filename, cacheEntry{
+		URL:          srcURL,
+		ResolvedURL:  resolvedURL,
+		Hash:         &hash,
+		ETag:         response.Header.Get("ETag"),
+		LastModified: response.Header.Get("Last-Modified"),
+	})
+}
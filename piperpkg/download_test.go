@@ -0,0 +1,65 @@
+package piperpkg
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloadConcurrent(t *testing.T) {
+	const n = 8
+	s := newFixtureServer(t, testVoiceFiles())
+	s.gate = make(chan struct{})
+	d := &Downloader{Dir: t.TempDir(), Client: s.Client(), MinSizes: testMinSizes}
+	url := s.URL + "/voices/en_GB-test-low.onnx"
+
+	var (
+		started sync.WaitGroup
+		done    sync.WaitGroup
+	)
+	filenames := make([]string, n)
+	errs := make([]error, n)
+	for i := range n {
+		started.Add(1)
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			started.Done()
+			filenames[i], errs[i] = d.Download(context.Background(), url)
+		}()
+	}
+	started.Wait()
+	// let every goroutine reach Download before the first one finishes,
+	// after which the others would revalidate the cached file
+	time.Sleep(100 * time.Millisecond)
+	close(s.gate)
+	done.Wait()
+
+	for i := range n {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if filenames[i] != filenames[0] {
+			t.Errorf("downloads returned %q and %q", filenames[0], filenames[i])
+		}
+	}
+	if got := readFile(t, filenames[0]); got != string(testONNX()) {
+		t.Errorf("downloaded %d bytes, want %d", len(got), len(testONNX()))
+	}
+	if hits := s.requests("/voices/en_GB-test-low.onnx"); hits != 1 {
+		t.Errorf("server got %d requests, want 1", hits)
+	}
+}
+
+func TestDownloadDefaultClient(t *testing.T) {
+	s := newFixtureServer(t, testVoiceFiles())
+	d := &Downloader{Dir: t.TempDir()}
+	filename, err := d.Download(context.Background(), s.URL+"/voices/en_GB-test-low.onnx.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filename); got != testVoiceJSON {
+		t.Errorf("downloaded %q, want %q", got, testVoiceJSON)
+	}
+}
@@ -0,0 +1,312 @@
+package piperpkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mholt/archiver/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Extract writes f, an entry of an archive, under rootDir. Directories are
+// created with their recorded mode and modification time, which is kept
+// when entries are later extracted into them. Existing files are kept, unless
+// f is a regular file and they don't match its size, as left by an
+// interrupted extraction.
+func Extract(ctx context.Context, rootDir string, f archiver.File) error {
+	return ExtractWith(ctx, rootDir, f, false, nil)
+}
+
+// ExtractOverwrite is like Extract, but replaces existing files.
+func ExtractOverwrite(ctx context.Context, rootDir string, f archiver.File) error {
+	return ExtractWith(ctx, rootDir, f, true, nil)
+}
+
+// ExtractedFile describes a file or symlink written by ExtractWith.
+type ExtractedFile struct {
+	// Name is the entry's name in the archive.
+	Name string
+	Size int64
+	// Path is where the entry was written.
+	Path string
+}
+
+// ExtractWith is like Extract, or ExtractOverwrite if overwrite is set, and
+// calls onExtracted, if not nil, once f is written. Directories and skipped
+// files aren't reported.
+func ExtractWith(ctx context.Context, rootDir string, f archiver.File, overwrite bool, onExtracted func(ExtractedFile)) error {
+	filename, err := extract(ctx, rootDir, f, overwrite)
+	if err != nil || filename == "" || onExtracted == nil {
+		return err
+	}
+	onExtracted(ExtractedFile{Name: f.NameInArchive, Size: f.Size(), Path: filename})
+	return nil
+}
+
+func extract(ctx context.Context, rootDir string, f archiver.File, overwrite bool) (_ string, retErr error) {
+	info, err := f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to read file info: %w", err)
+	}
+
+	filename, err := extractPath(rootDir, f.NameInArchive)
+	if err != nil {
+		return "", err
+	}
+
+	if info.IsDir() {
+		if err := checkNoSymlinks(rootDir, filename); err != nil {
+			return "", err
+		}
+		return "", extractDir(filename, info)
+	}
+	if err := checkNoSymlinks(rootDir, filepath.Dir(filename)); err != nil {
+		return "", err
+	}
+
+	existing, err := os.Lstat(filename)
+	if err == nil && !overwrite && !staleFile(existing, info) {
+		log.Debug().Str("file", filename).Msg("skipped existing file")
+		return "", nil
+	}
+
+	parent := filepath.Dir(filename)
+	if parentInfo, err := os.Stat(parent); err == nil {
+		// adding an entry updates the modification time of its directory
+		defer os.Chtimes(parent, time.Time{}, parentInfo.ModTime())
+	} else {
+		os.MkdirAll(parent, 0o755)
+	}
+
+	if existing != nil {
+		// removed rather than truncated so symlinks aren't followed
+		if err := os.Remove(filename); err != nil {
+			return "", fmt.Errorf("failed to replace %q: %w", filename, err)
+		}
+	}
+
+	if info.Mode().Type()&os.ModeSymlink == os.ModeSymlink {
+		linkTarget, err := symlinkTarget(f)
+		if err != nil {
+			return "", err
+		}
+		if err := checkLinkTarget(rootDir, filename, linkTarget); err != nil {
+			return "", err
+		}
+		err = os.Symlink(linkTarget, filename)
+		if err != nil && runtime.GOOS == "windows" {
+			// creating symlinks needs elevated privileges or developer mode
+			// on Windows, so fall back to a copy of the target
+			err = copyLinkTarget(rootDir, filename, linkTarget)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to symlink %q to %q: %w", filename, linkTarget, err)
+		}
+		return filename, nil
+	}
+
+	if !info.Mode().IsRegular() {
+		return "", nil
+	}
+
+	reader, err := f.Open()
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer reader.Close()
+	writer, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, f.Mode().Perm())
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer func() {
+		closeErr := writer.Close()
+		if retErr != nil {
+			return
+		}
+		if closeErr != nil {
+			retErr = fmt.Errorf("failed to close file: %w", closeErr)
+		}
+	}()
+	if _, err := io.Copy(writer, reader); err != nil {
+		return "", fmt.Errorf("failed to copy file: %w", err)
+	}
+	return filename, nil
+}
+
+// ExtractArchive unpacks the archive filename, or the embedded archive of the
+// generated package in the directory filename, into outDir, replacing
+// existing files if overwrite is set and calling onExtracted, if not nil, for
+// each file written. It returns the names of the entries in the archive.
+func ExtractArchive(ctx context.Context, filename, outDir string, overwrite bool, onExtracted func(ExtractedFile)) ([]string, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %q: %w", filename, err)
+	}
+	if info.IsDir() {
+		if filename, err = findArchive(filename); err != nil {
+			return nil, err
+		}
+	}
+	srcFile, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q: %w", filename, err)
+	}
+	defer srcFile.Close()
+	format, stream, err := archiver.Identify(srcFile.Name(), srcFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not identify %q: %w", srcFile.Name(), err)
+	}
+	extractor, ok := format.(archiver.Extractor)
+	if !ok {
+		return nil, fmt.Errorf("%T is not an archiver.Extractor: `%s`", format, srcFile.Name())
+	}
+	var names []string
+	folded := map[string]string{}
+	err = extractor.Extract(ctx, stream, nil, func(ctx context.Context, f archiver.File) error {
+		// Extract skips existing files, which would silently drop entries
+		// differing only in case
+		if err := checkEntryName(folded, f.NameInArchive); err != nil {
+			return err
+		}
+		if err := ExtractWith(ctx, outDir, f, overwrite, onExtracted); err != nil {
+			return fmt.Errorf("failed to extract %q: %w", f.NameInArchive, err)
+		}
+		if !f.IsDir() {
+			names = append(names, f.NameInArchive)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func findArchive(pkgDir string) (string, error) {
+	archive, err := embeddedArchive(pkgDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	if archive != "" {
+		return filepath.Join(pkgDir, archive), nil
+	}
+	for _, format := range slices.Sorted(maps.Keys(ArchiveFormats)) {
+		filename := filepath.Join(pkgDir, "dist"+ArchiveFormats[format].Extension)
+		if _, err := os.Stat(filename); err == nil {
+			return filename, nil
+		}
+	}
+	return "", fmt.Errorf("no archive found in %q", pkgDir)
+}
+
+func symlinkTarget(f archiver.File) (string, error) {
+	if f.LinkTarget != "" {
+		return f.LinkTarget, nil
+	}
+	reader, err := f.Open()
+	if err != nil {
+		return "", fmt.Errorf("failed to open symlink: %w", err)
+	}
+	defer reader.Close()
+	target, err := io.ReadAll(reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to read symlink target: %w", err)
+	}
+	return string(target), nil
+}
+
+func staleFile(existing, info fs.FileInfo) bool {
+	if !info.Mode().IsRegular() {
+		return false
+	}
+	return !existing.Mode().IsRegular() || existing.Size() != info.Size()
+}
+
+func extractPath(rootDir, name string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(name))
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("archive entry %q is outside of %q", name, rootDir)
+	}
+	return filepath.Join(rootDir, rel), nil
+}
+
+func extractDir(dirname string, info fs.FileInfo) error {
+	mode := info.Mode().Perm() | 0o700
+	if err := os.MkdirAll(dirname, mode); err != nil {
+		return fmt.Errorf("failed to create directory %q: %w", dirname, err)
+	}
+	// MkdirAll is a no-op for existing directories and applies the umask
+	if err := os.Chmod(dirname, mode); err != nil {
+		return fmt.Errorf("failed to set mode of %q: %w", dirname, err)
+	}
+	if err := os.Chtimes(dirname, time.Time{}, info.ModTime()); err != nil {
+		return fmt.Errorf("failed to set modification time of %q: %w", dirname, err)
+	}
+	return nil
+}
+
+func copyLinkTarget(rootDir, filename, linkTarget string) error {
+	if err := checkLinkTarget(rootDir, filename, linkTarget); err != nil {
+		return err
+	}
+	return copyFile(filename, filepath.Join(filepath.Dir(filename), filepath.FromSlash(linkTarget)))
+}
+
+func checkNoSymlinks(rootDir, dirname string) error {
+	rel, err := filepath.Rel(rootDir, dirname)
+	if err != nil || rel == "." || !filepath.IsLocal(rel) {
+		return nil
+	}
+	dir := rootDir
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, elem)
+		info, err := os.Lstat(dir)
+		if err != nil {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to extract through symlink %q", dir)
+		}
+	}
+	return nil
+}
+
+func checkLinkTarget(rootDir, filename, linkTarget string) error {
+	target := filepath.FromSlash(linkTarget)
+	if linkTarget == "" || filepath.IsAbs(target) || strings.HasPrefix(linkTarget, "/") || filepath.VolumeName(target) != "" {
+		return fmt.Errorf("link target %q of %q is not a relative path", linkTarget, filename)
+	}
+	elems := strings.Split(target, string(filepath.Separator))
+	dir := filepath.Dir(filename)
+	for i, elem := range elems {
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			dir = filepath.Dir(dir)
+		default:
+			dir = filepath.Join(dir, elem)
+		}
+		rel, err := filepath.Rel(rootDir, dir)
+		if err != nil || !filepath.IsLocal(rel) {
+			return fmt.Errorf("link target %q of %q is outside of %q", linkTarget, filename, rootDir)
+		}
+		if i == len(elems)-1 {
+			break
+		}
+		if info, err := os.Lstat(dir); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("link target %q of %q passes through symlink %q", linkTarget, filename, dir)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package piperpkg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExtractArchiveSymlinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []testEntry
+		// wantErr is part of the error expected, if any.
+		wantErr string
+	}{
+		{
+			name: "relative link",
+			entries: []testEntry{
+				{Name: "lib/libpiper.so.1", Body: "library", Mode: 0o644},
+				{Name: "lib/libpiper.so", Link: "libpiper.so.1", Mode: 0o777},
+				{Name: "libpiper.so", Link: "lib/../lib/libpiper.so.1", Mode: 0o777},
+			},
+		},
+		{
+			name:    "absolute link",
+			entries: []testEntry{{Name: "a", Link: "/etc", Mode: 0o777}},
+			wantErr: "not a relative path",
+		},
+		{
+			name: "link outside of root",
+			entries: []testEntry{
+				{Name: "a", Link: "../..", Mode: 0o777},
+				{Name: "a/x", Body: "escaped", Mode: 0o644},
+			},
+			wantErr: "outside of",
+		},
+		{
+			name: "write through link",
+			entries: []testEntry{
+				{Name: "sub/file", Body: "inside", Mode: 0o644},
+				{Name: "a", Link: "sub", Mode: 0o777},
+				{Name: "a/x", Body: "through link", Mode: 0o644},
+			},
+			wantErr: "through symlink",
+		},
+		{
+			name: "link through link",
+			entries: []testEntry{
+				{Name: "r/file", Body: "inside", Mode: 0o644},
+				{Name: "p/q/y", Link: "../../r", Mode: 0o777},
+				// lexically p, but r/../.. through y
+				{Name: "p/q/x", Link: "y/../..", Mode: 0o777},
+			},
+			wantErr: "passes through symlink",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			filename := filepath.Join(dir, "archive.tar.gz")
+			if err := os.WriteFile(filename, testTarGz(t, tt.entries), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			outDir := filepath.Join(dir, "out")
+			_, err := ExtractArchive(context.Background(), filename, outDir, false, nil)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, name := range []string{"lib/libpiper.so", "libpiper.so"} {
+					if got := readFile(t, filepath.Join(outDir, name)); got != "library" {
+						t.Errorf("%s resolves to %q", name, got)
+					}
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "x")); err == nil {
+				t.Error("extracted a file outside of the output directory")
+			}
+		})
+	}
+}
+
+func TestCopyLinkTarget(t *testing.T) {
+	rootDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(rootDir, "target"), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(filepath.Dir(rootDir), "outside")
+	tests := []struct {
+		linkTarget string
+		wantErr    bool
+	}{
+		{"target", false},
+		{"./target", false},
+		{filepath.ToSlash(outside), true},
+		{"../outside", true},
+	}
+	for _, tt := range tests {
+		filename := filepath.Join(rootDir, "link")
+		os.Remove(filename)
+		err := copyLinkTarget(rootDir, filename, tt.linkTarget)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("copyLinkTarget(%q) returned %v", tt.linkTarget, err)
+		}
+		if err == nil {
+			if got := readFile(t, filename); got != "data" {
+				t.Errorf("copy of %q holds %q", tt.linkTarget, got)
+			}
+		}
+	}
+}
+
+func TestExtractArchiveNamed(t *testing.T) {
+	tests := []struct {
+		name string
+		// configure sets the builder's options, and archive is the archive
+		// of the package they generate.
+		configure func(b *PackageBuilder)
+		archive   string
+	}{
+		{"default", func(b *PackageBuilder) {}, "dist.tzst"},
+		{"gzip", func(b *PackageBuilder) { b.ArchiveFormat = "tgz" }, "dist.tgz"},
+		{"archive name", func(b *PackageBuilder) { b.ArchiveFilename = "voice.bin" }, "voice.bin"},
+		{"lazy", func(b *PackageBuilder) {
+			b.Mode = ModeLazy
+			b.LazyURL = "https://example.com/archives"
+			b.ArchiveFilename = "voice.tar.zst"
+		}, "voice.tar.zst"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFixtureServer(t, testVoiceFiles())
+			b := newTestBuilder(t, s)
+			tt.configure(b)
+			voice := VoiceSpec{Name: "test", URLs: []string{
+				s.URL + "/voices/en_GB-test-low.onnx",
+				s.URL + "/voices/en_GB-test-low.onnx.json",
+			}}
+			if _, err := b.InstallVoice(context.Background(), voice, "v1.0.0", nil); err != nil {
+				t.Fatal(err)
+			}
+			pkgDir := filepath.Join(b.Dir, "piper-voice-test-low")
+			if filename, err := findArchive(pkgDir); err != nil || filename != filepath.Join(pkgDir, tt.archive) {
+				t.Errorf("found archive %q (%v), want %s", filename, err, tt.archive)
+			}
+			// dist.tzst left over from a previous run isn't picked instead
+			if tt.archive != "dist.tzst" {
+				if err := os.WriteFile(filepath.Join(pkgDir, "dist.tzst"), []byte("stale"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			outDir := t.TempDir()
+			names, err := ExtractArchive(context.Background(), pkgDir, outDir, false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			slices.Sort(names)
+			if want := []string{"voice.json", "voice.onnx"}; !slices.Equal(names, want) {
+				t.Errorf("extracted %q, want %q", names, want)
+			}
+			info, err := ReadPackage(pkgDir, MetadataFilename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(info.Entries) != 2 || info.Voices["voice.json"].SampleRate != 22050 {
+				t.Errorf("read package %+v", info)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package piperpkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+var xxh3GoSum = []string{
+	"github.com/klauspost/cpuid/v2 v2.0.9 h1:lgaqFMSdTdQYdZ04uHyN2d/eKdOMyi2YLSvlQIBFYa4=",
+	"github.com/klauspost/cpuid/v2 v2.0.9/go.mod h1:FInQzS24/EEf25PyTYn52gqo7WaD8xa0213Md/qVLRg=",
+	"github.com/zeebo/assert v1.3.0 h1:g7C04CbJuIDKNPFHmsk4hwZDO5O+kntRxzaUoNXj+IQ=",
+	"github.com/zeebo/assert v1.3.0/go.mod h1:Pq9JiuJQpG8JLJdtkwrJESF0Foym2/D9XMU5ciN/wJ0=",
+	"github.com/zeebo/xxh3 v1.0.2 h1:xZmwmqxHZA8AI603jOQ0tMqmBr9lPeFwGg6d+xy9DC0=",
+	"github.com/zeebo/xxh3 v1.0.2/go.mod h1:5NWz9Sef7zIDm2JHfFlcQvNekmcEl9ekUZQQKCYaDcA=",
+}
+
+func (b *PackageBuilder) writeGoSum(ctx context.Context, pkgDir string, deps []packageDep, lazy bool) error {
+	var lines []string
+	if lazy {
+		lines = append(lines, xxh3GoSum...)
+	}
+	assetDir, assetLines, err := b.assetModule(ctx)
+	if err != nil {
+		return err
+	}
+	lines = append(lines, assetLines...)
+	dirs := []string{assetDir}
+	for _, dep := range deps {
+		dirs = append(dirs, dep.Dir)
+	}
+	for _, dir := range dirs {
+		src, err := os.ReadFile(filepath.Join(dir, "go.sum"))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to read go.sum: %w", err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(src))
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+	slices.Sort(lines)
+	lines = slices.Compact(lines)
+	if len(lines) == 0 {
+		return nil
+	}
+	return writeFileAtomic(filepath.Join(pkgDir, "go.sum"), []byte(strings.Join(lines, "\n")+"\n"), 0o644)
+}
+
+func (b *PackageBuilder) assetModule(ctx context.Context) (string, []string, error) {
+	modPath, version := AssetModulePath, b.AssetVersion
+	if replacement, ok := b.Replace[AssetModulePath]; ok {
+		mod, replVersion, ok := strings.Cut(replacement, "@")
+		if !ok {
+			dir, err := filepath.Abs(replacement)
+			if err != nil {
+				return "", nil, fmt.Errorf("failed to resolve replacement of %s: %w", AssetModulePath, err)
+			}
+			return dir, nil, nil
+		}
+		modPath, version = mod, replVersion
+	}
+	cmd := exec.CommandContext(ctx, "go", "env", "GOMODCACHE")
+	cmd.Env = b.goEnv()
+	out, err := cmd.Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to locate the module cache: %w", err)
+	}
+	modCache := strings.TrimSpace(string(out))
+	escPath, escVersion := escapeModulePath(modPath), escapeModulePath(version)
+	download := filepath.Join(modCache, "cache", "download", filepath.FromSlash(escPath), "@v", escVersion)
+	zipHash, err := os.ReadFile(download + ".ziphash")
+	if err != nil {
+		return "", nil, fmt.Errorf("%s %s is not in the module cache: %w", modPath, version, err)
+	}
+	goMod, err := os.ReadFile(download + ".mod")
+	if err != nil {
+		return "", nil, fmt.Errorf("%s %s is not in the module cache: %w", modPath, version, err)
+	}
+	lines := []string{
+		modPath + " " + version + " " + strings.TrimSpace(string(zipHash)),
+		modPath + " " + version + "/go.mod " + goModHash(goMod),
+	}
+	return filepath.Join(modCache, filepath.FromSlash(escPath)+"@"+escVersion), lines, nil
+}
+
+func goModHash(src []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%x  go.mod\n", sha256.Sum256(src))
+	return "h1:" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func escapeModulePath(s string) string {
+	var escaped strings.Builder
+	for _, r := range s {
+		if unicode.IsUpper(r) {
+			escaped.WriteByte('!')
+			r = unicode.ToLower(r)
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
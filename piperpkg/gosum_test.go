@@ -0,0 +1,55 @@
+package piperpkg
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestXXH3GoSum(t *testing.T) {
+	src, err := os.ReadFile(filepath.Join("..", "go.sum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range xxh3GoSum {
+		if !strings.Contains(string(src), line+"\n") {
+			t.Errorf("go.sum lacks %q", line)
+		}
+	}
+}
+
+func TestSkipTidyBuildsOffline(t *testing.T) {
+	assetDir := t.TempDir()
+	for name, src := range map[string]string{
+		"go.mod":   "module " + AssetModulePath + "\n\ngo 1.21\n",
+		"asset.go": "package asset\n\nimport \"io/fs\"\n\ntype Asset struct {\n\tName string\n\tFS   fs.FS\n}\n",
+	} {
+		if err := os.WriteFile(filepath.Join(assetDir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, mode := range []string{ModeEmbed, ModeLazy} {
+		t.Run(mode, func(t *testing.T) {
+			s := newFixtureServer(t, testVoiceFiles())
+			b := newTestBuilder(t, s)
+			b.SkipBuild = false
+			b.SkipTidy = true
+			b.AssetVersion = "v0.1.0"
+			b.Replace = map[string]string{AssetModulePath: assetDir}
+			b.GoEnv = maps.Clone(DefaultGoEnv)
+			b.GoEnv["GOPROXY"] = "off"
+			b.Mode = mode
+			b.LazyURL = "https://example.com/archives"
+			voice := VoiceSpec{Name: "test", URLs: []string{
+				s.URL + "/voices/en_GB-test-low.onnx",
+				s.URL + "/voices/en_GB-test-low.onnx.json",
+			}}
+			if _, err := b.InstallVoice(context.Background(), voice, "v1.0.0", nil); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
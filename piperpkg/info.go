@@ -0,0 +1,80 @@
+package piperpkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// PackageInfo describes a generated package.
+type PackageInfo struct {
+	Meta    Meta
+	Entries []ArchiveEntry
+	// Voices maps each voice.json in the archive to the voice it configures.
+	Voices map[string]VoiceInfo `json:",omitempty"`
+}
+
+// ArchiveEntry describes an entry of the embedded archive.
+type ArchiveEntry struct {
+	Name string
+	Size int64
+	Mode string
+}
+
+// ReadPackage reads the metadata and lists the archive of the generated
+// package in pkgDir.
+func ReadPackage(pkgDir, metadataFilename string) (*PackageInfo, error) {
+	src, err := os.ReadFile(filepath.Join(pkgDir, metadataFilename))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	info := &PackageInfo{}
+	if err := json.Unmarshal(src, &info.Meta); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata: %w", err)
+	}
+	filename, err := findArchive(pkgDir)
+	if err != nil {
+		return nil, err
+	}
+	format, err := archiveFormatOf(filename)
+	if err != nil {
+		// custom archive names don't tell the format, but the metadata does
+		if format, err = compressionFormat(info.Meta.Compression); err != nil {
+			return nil, err
+		}
+	}
+	tarball, err := OpenTarball(filename, format)
+	if err != nil {
+		return nil, err
+	}
+	defer tarball.Close()
+	for {
+		h, r, err := tarball.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %q: %w", filename, err)
+		}
+		mode := h.FileInfo().Mode()
+		if mode.IsDir() {
+			continue
+		}
+		info.Entries = append(info.Entries, ArchiveEntry{Name: h.Name, Size: h.Size, Mode: mode.String()})
+		if path.Base(h.Name) != "voice.json" || !mode.IsRegular() {
+			continue
+		}
+		var config voiceConfig
+		if err := json.NewDecoder(r).Decode(&config); err != nil {
+			return nil, fmt.Errorf("failed to parse %q: %w", h.Name, err)
+		}
+		if info.Voices == nil {
+			info.Voices = map[string]VoiceInfo{}
+		}
+		info.Voices[h.Name] = config.info()
+	}
+	return info, nil
+}
@@ -0,0 +1,151 @@
+package piperpkg
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// PackageLocation describes a package to PackageBuilder.Layout.
+type PackageLocation struct {
+	// Kind is one of the Kind constants.
+	Kind string
+	// Package is the default package name, e.g. "piper-voice-jenny".
+	Package string
+	// Name is the voice, bundle or platform the package is generated for.
+	Name string
+	// Language and Quality describe the voice of a voice package.
+	Language string
+	Quality  string
+	// OS and Arch are the platform of a binary package, if known.
+	OS   string
+	Arch string
+}
+
+// ParseLayout parses a PackageBuilder.Layout template, e.g.
+// "{{.Kind}}/{{.Language}}/{{.Name}}".
+func ParseLayout(text string) (*template.Template, error) {
+	return template.New("layout").Option("missingkey=error").Parse(text)
+}
+
+// VoiceLocation returns the location of the package generated for voice.
+func VoiceLocation(voice VoiceSpec) PackageLocation {
+	return PackageLocation{
+		Kind:     KindVoice,
+		Package:  VoicePackageName(voice),
+		Name:     voice.Name,
+		Language: voiceLanguage(voice.URLs),
+		Quality:  voiceQuality(voice.URLs),
+	}
+}
+
+// BundleLocation returns the location of the package generated for a bundle.
+func BundleLocation(bundleName string) PackageLocation {
+	return PackageLocation{Kind: KindBundle, Package: BundlePackageName(bundleName), Name: bundleName}
+}
+
+// SharedLocation is the location of the package holding files shared across
+// voices.
+var SharedLocation = PackageLocation{Kind: KindShared, Package: "piper-voices-shared", Name: "shared"}
+
+// PiperLocation returns the location of the package generated for platform.
+func PiperLocation(platform string, release PiperRelease) PackageLocation {
+	return PackageLocation{
+		Kind:    KindBinary,
+		Package: PiperPackageName(platform),
+		Name:    platform,
+		OS:      release.OS,
+		Arch:    release.Arch,
+	}
+}
+
+// ParseNameTemplate parses a PackageBuilder.VoiceName or BinName template,
+// e.g. "tts-{{.Language}}-{{.Name}}".
+func ParseNameTemplate(text string) (*template.Template, error) {
+	return template.New("name").Option("missingkey=error").Parse(text)
+}
+
+// PackageName returns the name of the package at loc, which is also the last
+// element of its module path: b.VoiceName or b.BinName applied to loc, or
+// loc.Package by default.
+func (b *PackageBuilder) PackageName(loc PackageLocation) (string, error) {
+	var tmpl *template.Template
+	switch loc.Kind {
+	case KindVoice:
+		tmpl = b.VoiceName
+	case KindBinary:
+		tmpl = b.BinName
+	}
+	name := loc.Package
+	if tmpl != nil {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, loc); err != nil {
+			return "", fmt.Errorf("failed to apply name template to %s: %w", loc.Package, err)
+		}
+		name = strings.TrimSpace(buf.String())
+	}
+	if err := checkModulePathElement(name); err != nil {
+		return "", fmt.Errorf("invalid package name for %s %q: %w", loc.Kind, loc.Name, err)
+	}
+	return name, nil
+}
+
+func (b *PackageBuilder) modulePath(name string) string {
+	return "github.com/piper-tts-go/" + name + b.majorSuffix()
+}
+
+func (b *PackageBuilder) majorSuffix() string {
+	if b.MajorVersion < 2 {
+		return ""
+	}
+	return "/v" + strconv.Itoa(b.MajorVersion)
+}
+
+func trimMajorSuffix(modPath string) string {
+	dir, elem := path.Split(modPath)
+	if n, err := strconv.Atoi(strings.TrimPrefix(elem, "v")); err == nil && n >= 2 && "v"+strconv.Itoa(n) == elem {
+		return strings.TrimSuffix(dir, "/")
+	}
+	return modPath
+}
+
+func (b *PackageBuilder) checkMajorVersion(version string) error {
+	if b.MajorVersion == 0 {
+		return nil
+	}
+	majorText, _, _ := strings.Cut(strings.TrimPrefix(version, "v"), ".")
+	major, err := strconv.Atoi(majorText)
+	if err != nil {
+		return fmt.Errorf("version %q has no major version to check against %d", version, b.MajorVersion)
+	}
+	if major == b.MajorVersion || b.MajorVersion == 1 && major == 0 {
+		return nil
+	}
+	return fmt.Errorf("version %q doesn't match major version %d", version, b.MajorVersion)
+}
+
+// PackageDir returns the directory under b.Dir that the package at loc is
+// generated into: b.Layout applied to loc, or the package name by default.
+func (b *PackageBuilder) PackageDir(loc PackageLocation) (string, error) {
+	name, err := b.PackageName(loc)
+	if err != nil {
+		return "", err
+	}
+	loc.Package = name
+	if b.Layout == nil {
+		return filepath.Join(b.Dir, loc.Package), nil
+	}
+	var buf bytes.Buffer
+	if err := b.Layout.Execute(&buf, loc); err != nil {
+		return "", fmt.Errorf("failed to apply layout to %s: %w", loc.Package, err)
+	}
+	rel := filepath.Clean(filepath.FromSlash(strings.TrimSpace(buf.String())))
+	if rel == "." || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("layout gives %s the invalid directory %q", loc.Package, buf.String())
+	}
+	return filepath.Join(b.Dir, rel), nil
+}
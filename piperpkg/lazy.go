@@ -0,0 +1,164 @@
+package piperpkg
+
+import (
+	"go/format"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ModeEmbed generates packages embedding their archive.
+	ModeEmbed = "embed"
+	// ModeLazy generates packages downloading their archive on first use.
+	ModeLazy = "lazy"
+)
+
+const (
+	xxh3Module  = "github.com/zeebo/xxh3"
+	xxh3Version = "v1.0.2"
+)
+
+func (b *PackageBuilder) lazyURL(pkgPath, version string) string {
+	return strings.TrimSuffix(b.LazyURL, "/") + "/" + path.Base(trimMajorSuffix(pkgPath)) + "/" + version + "/" + b.archiveFilename()
+}
+
+func (b *PackageBuilder) writeLazy(pkgDir, embedPkgName, archiveURL string, meta Meta, hashedFiles []string) error {
+	hashedFiles = slices.Sorted(slices.Values(hashedFiles))
+	quoted := make([]string, len(hashedFiles))
+	for i, name := range hashedFiles {
+		quoted[i] = strconv.Quote(name)
+	}
+	src, err := format.Source([]byte(`// GENERATED FILE
+
+package ` + embedPkgName + `
+
+import (
+	"embed"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"` + xxh3Module + `"
+)
+
+// ArchiveURL is where the archive is downloaded from on first use.
+const ArchiveURL = ` + strconv.Quote(archiveURL) + `
+
+const (
+	archiveName = ` + strconv.Quote(b.archiveFilename()) + `
+	// metaHash is the Hash of the package's metadata, covering the archive
+	// and the embedded files.
+	metaHash = ` + strconv.Quote(meta.Hash.String()) + `
+)
+
+// hashedFiles are the files covered by metaHash, in the order hashed.
+var hashedFiles = []string{` + strings.Join(quoted, ", ") + `}
+
+// lazyFS serves the embedded files, and the archive from the user's cache
+// directory, downloading it on first use.
+type lazyFS struct {
+	embedded embed.FS
+}
+
+func (f lazyFS) Open(name string) (iofs.File, error) {
+	if name != archiveName {
+		return f.embedded.Open(name)
+	}
+	filename, err := cachedArchive()
+	if err != nil {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return os.Open(filename)
+}
+
+var cachedArchive = sync.OnceValues(func() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate cache directory: %w", err)
+	}
+	filename := filepath.Join(dir, "piper-go", metaHash+"-"+archiveName)
+	if verifyArchive(filename) == nil {
+		return filename, nil
+	}
+	if err := downloadArchive(filename); err != nil {
+		return "", fmt.Errorf("failed to download %s: %w", ArchiveURL, err)
+	}
+	return filename, nil
+})
+
+// downloadArchive downloads ArchiveURL to filename if it matches metaHash.
+func downloadArchive(filename string) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return err
+	}
+	resp, err := http.Get(ArchiveURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), ".download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := verifyArchive(tmp.Name()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// verifyArchive checks that the archive at filename, along with the embedded
+// files, matches metaHash.
+func verifyArchive(filename string) error {
+	h := xxh3.New()
+	for _, name := range hashedFiles {
+		var (
+			f   io.ReadCloser
+			err error
+		)
+		if name == archiveName {
+			f, err = os.Open(filename)
+		} else {
+			f, err = fs.Open(name)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	sum := h.Sum128()
+	if got := fmt.Sprintf("%016x%016x", sum.Hi, sum.Lo); got != metaHash {
+		return fmt.Errorf("archive hash mismatch: got %s, want %s", got, metaHash)
+	}
+	return nil
+}
+`))
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(pkgDir, "lazy.go"), src, 0o644); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(pkgDir, ".gitignore"), []byte("/"+b.archiveFilename()+"\n"), 0o644)
+}
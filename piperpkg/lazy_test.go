@@ -0,0 +1,28 @@
+package piperpkg
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestLazyPackageRequiresXXH3(t *testing.T) {
+	// lazy packages require the version of xxh3 this module is tested with
+	if err := checkRequire("..", xxh3Module, xxh3Version); err != nil {
+		t.Fatal(err)
+	}
+	s := newFixtureServer(t, testVoiceFiles())
+	b := newTestBuilder(t, s)
+	b.Mode = ModeLazy
+	b.LazyURL = "https://example.com/archives"
+	voice := VoiceSpec{Name: "test", URLs: []string{
+		s.URL + "/voices/en_GB-test-low.onnx",
+		s.URL + "/voices/en_GB-test-low.onnx.json",
+	}}
+	if _, err := b.InstallVoice(context.Background(), voice, "v1.0.0", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkRequire(filepath.Join(b.Dir, "piper-voice-test-low"), xxh3Module, xxh3Version); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,39 @@
+package piperpkg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LockFilename is the file LockDir locks in a directory.
+const LockFilename = ".piper-gen.lock"
+
+// ErrLocked is returned by LockDir when another process holds the lock.
+var ErrLocked = errors.New("locked by another process")
+
+// LockDir takes an exclusive advisory lock on dir, so concurrent piper-gen
+// runs don't share a download cache and package directories. It fails with
+// ErrLocked right away if another process holds the lock. The returned
+// function releases it, as does the process exiting.
+func LockDir(dir string) (func() error, error) {
+	filename := filepath.Join(dir, LockFilename)
+	f, err := lockFile(filename)
+	if errors.Is(err, ErrLocked) {
+		if src, readErr := os.ReadFile(filename); readErr == nil && len(strings.TrimSpace(string(src))) != 0 {
+			return nil, fmt.Errorf("%q is %w (pid %s)", dir, ErrLocked, strings.TrimSpace(string(src)))
+		}
+		return nil, fmt.Errorf("%q is %w", dir, ErrLocked)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock %q: %w", dir, err)
+	}
+	// the pid is only informative, for the error of other runs
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return f.Close, nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix && !windows
+
+package piperpkg
+
+import "os"
+
+func lockFile(filename string) (*os.File, error) {
+	return os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0o644)
+}
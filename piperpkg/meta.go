@@ -0,0 +1,193 @@
+package piperpkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/zeebo/xxh3"
+)
+
+type Meta struct {
+	Version string
+	Hash    Hash
+	// Files maps each regular file in the archive to the hash of its contents.
+	Files map[string]Hash `json:",omitempty"`
+	// Voices maps each voice of a bundle to the combined hash of its files.
+	Voices map[string]Hash `json:",omitempty"`
+	// Sources are the URLs the archive's contents were downloaded from.
+	Sources []string `json:",omitempty"`
+	// ResolvedSources maps the Sources that redirected to where they
+	// resolved to.
+	ResolvedSources map[string]string `json:",omitempty"`
+	// Compression is the compression applied to the archive, e.g. "zstd".
+	Compression string `json:",omitempty"`
+	// ArchiveSize is the size in bytes of the archive, and UncompressedSize
+	// the total size of the files in it.
+	ArchiveSize      int64 `json:",omitempty"`
+	UncompressedSize int64 `json:",omitempty"`
+	// SourceFormat is the format of the release archive a binary package
+	// was built from, e.g. "tar.gz" or "zip".
+	SourceFormat string `json:",omitempty"`
+	// Language is the language code of a voice, e.g. "en_GB".
+	Language string `json:",omitempty"`
+	// PhonemizerData is the directory of the archive holding espeak-ng data,
+	// if it was bundled.
+	PhonemizerData string `json:",omitempty"`
+	// GeneratedBy is the version of piper-gen that generated the package.
+	GeneratedBy string `json:",omitempty"`
+	// GeneratedAt is when the package was generated, in RFC 3339 format.
+	// It's taken from $SOURCE_DATE_EPOCH if set, for reproducible output.
+	GeneratedAt string `json:",omitempty"`
+	// Shared maps files left out of the archive to their hash in the
+	// archive of the shared package the package depends on.
+	Shared map[string]Hash `json:",omitempty"`
+	// Voice describes the voice of a voice package, and VoiceConfigs each
+	// voice of a bundle, from their voice.json.
+	Voice        *VoiceInfo           `json:",omitempty"`
+	VoiceConfigs map[string]VoiceInfo `json:",omitempty"`
+	// Members locates the compression frame of each file of archives
+	// written with Incremental, so the next run can copy those of the files
+	// that didn't change.
+	Members map[string]ArchiveMember `json:",omitempty"`
+}
+
+// VoiceInfo holds the main fields of a voice.json.
+type VoiceInfo struct {
+	Dataset  string `json:",omitempty"`
+	Language string `json:",omitempty"`
+	Quality  string `json:",omitempty"`
+	// SampleRate is the rate in Hz of the audio the voice produces.
+	SampleRate int `json:",omitempty"`
+	// NumSpeakers is 1 for single speaker voices, and Speakers maps the
+	// speaker names of a multi-speaker voice to their speaker ID.
+	NumSpeakers int            `json:",omitempty"`
+	Speakers    map[string]int `json:",omitempty"`
+}
+
+// Version is the version of piper-gen, set at build time with
+// -ldflags "-X github.com/piper-tts-go/piper-gen/piperpkg.Version=v1.2.3".
+var Version string
+
+// ToolVersion returns Version, or the module version piper-gen was built
+// from if it isn't set.
+func ToolVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+func generationTime() (time.Time, error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return time.Now().UTC(), nil
+	}
+	seconds, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %w", epoch, err)
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+// Hash is an xxh3 128-bit hash that encodes to JSON as a hex string.
+type Hash xxh3.Uint128
+
+func (h Hash) String() string {
+	return fmt.Sprintf("%016x%016x", h.Hi, h.Lo)
+}
+
+func (h Hash) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.String())
+}
+
+// UnmarshalJSON accepts the hex form as well as the {"Hi":…,"Lo":…} object
+// written by earlier versions.
+func (h *Hash) UnmarshalJSON(src []byte) error {
+	var legacy xxh3.Uint128
+	if err := json.Unmarshal(src, &legacy); err == nil {
+		*h = Hash(legacy)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(src, &s); err != nil {
+		return err
+	}
+	parsed, err := ParseHash(s)
+	if err != nil {
+		return err
+	}
+	*h = parsed
+	return nil
+}
+
+// ParseHash parses the hex form produced by Hash.String.
+func ParseHash(s string) (Hash, error) {
+	if len(s) != 32 {
+		return Hash{}, fmt.Errorf("invalid hash %q: expected 32 hex digits", s)
+	}
+	hi, err := strconv.ParseUint(s[:16], 16, 64)
+	if err != nil {
+		return Hash{}, fmt.Errorf("invalid hash %q: %w", s, err)
+	}
+	lo, err := strconv.ParseUint(s[16:], 16, 64)
+	if err != nil {
+		return Hash{}, fmt.Errorf("invalid hash %q: %w", s, err)
+	}
+	return Hash{Hi: hi, Lo: lo}, nil
+}
+
+func hashFile(h hash.Hash, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	return nil
+}
+
+// InstallMeta hashes the files named by names, relative to pkgDir, into
+// meta.Hash and writes meta to metaFilename. Files are hashed in order of
+// their embedded names so the hash doesn't depend on where pkgDir is.
+func InstallMeta(metaFilename string, meta Meta, pkgDir string, names ...string) (Meta, error) {
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+
+	h := xxh3.New()
+	for _, name := range names {
+		filename := filepath.Join(pkgDir, filepath.FromSlash(name))
+		if err := hashFile(h, filename); err != nil {
+			return Meta{}, fmt.Errorf("failed to hash file %q: %w", filename, err)
+		}
+	}
+	meta.Hash = Hash(h.Sum128())
+	meta.GeneratedBy = ToolVersion()
+	generatedAt, err := generationTime()
+	if err != nil {
+		return Meta{}, err
+	}
+	meta.GeneratedAt = generatedAt.Format(time.RFC3339)
+	src, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return Meta{}, fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+	src = append(src, '\n')
+	// written atomically as skipping unchanged packages relies on reading it
+	if err := writeFileAtomic(metaFilename, src, 0o644); err != nil {
+		return Meta{}, fmt.Errorf("failed to write metadata: %w", err)
+	}
+	return meta, nil
+}
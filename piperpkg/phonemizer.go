@@ -0,0 +1,85 @@
+package piperpkg
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mholt/archiver/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// PhonemizerDataDir is the directory of the archive that espeak-ng data is
+// stored under when PackageBuilder.PhonemizerData is set.
+const PhonemizerDataDir = "espeak-ng-data"
+
+func (b *PackageBuilder) appendPhonemizerData(ctx context.Context, tarball *Tarball, prefix string) error {
+	src := b.PhonemizerData
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		filename, err := b.Downloader.Download(ctx, src)
+		if err != nil {
+			return fmt.Errorf("failed to download phonemizer data: %w", err)
+		}
+		src = filename
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("failed to stat phonemizer data: %w", err)
+	}
+	dir := prefix + PhonemizerDataDir + "/"
+	if info.IsDir() {
+		return filepath.WalkDir(src, func(filename string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(src, filename)
+			if err != nil {
+				return err
+			}
+			return tarball.AppendFile(dir+filepath.ToSlash(rel), filename)
+		})
+	}
+
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %w", src, err)
+	}
+	defer srcFile.Close()
+	format, stream, err := archiver.Identify(srcFile.Name(), srcFile)
+	if err != nil {
+		return fmt.Errorf("could not identify %q: %w", srcFile.Name(), err)
+	}
+	extractor, ok := format.(archiver.Extractor)
+	if !ok {
+		return fmt.Errorf("%T is not an archiver.Extractor: `%s`", format, srcFile.Name())
+	}
+	return extractor.Extract(ctx, stream, nil, func(ctx context.Context, f archiver.File) error {
+		if !f.Mode().IsRegular() {
+			return nil
+		}
+		name := archiveEntryName(f.NameInArchive)
+		// archives usually contain the data directory itself, possibly
+		// nested, e.g. piper/espeak-ng-data/phontab
+		if i := strings.Index("/"+name, "/"+PhonemizerDataDir+"/"); i >= 0 {
+			name = name[i+len(PhonemizerDataDir)+1:]
+		}
+		if name == "" {
+			return nil
+		}
+		log.Debug().Str("entry", name).Msg("adding phonemizer data entry")
+		reader, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		return tarball.Append(&tar.Header{
+			Name: dir + name,
+			Mode: int64(f.Mode().Perm()),
+			Size: f.Size(),
+		}, reader)
+	})
+}
@@ -0,0 +1,327 @@
+package piperpkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/mholt/archiver/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// PiperRelease describes where to find piper for a platform and which parts
+// of the release archive make up its runtime bundle.
+type PiperRelease struct {
+	URL string
+	// Version, if set, is stamped into the package in place of the version
+	// passed to InstallPiper.
+	Version string
+	// Paths are the files and directories to extract from the release archive.
+	Paths []string
+	// StripPrefix is removed from the name of every extracted entry.
+	StripPrefix string
+	// OS and Arch are the GOOS and GOARCH the release runs on, used to
+	// decide whether it can be smoke tested.
+	OS, Arch string
+}
+
+func archiveEntryName(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func pathIncluded(paths []string, name string) bool {
+	for _, p := range paths {
+		p = archiveEntryName(p)
+		if name == p || strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *PackageBuilder) appendRelease(ctx context.Context, filename, destFilename string, release PiperRelease, stripPath string) (*Tarball, archiver.Format, int, error) {
+	srcFile, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to open %q: %w", filename, err)
+	}
+	defer srcFile.Close()
+
+	format, stream, err := archiver.Identify(srcFile.Name(), srcFile)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("%w: could not identify %q: %w", errCorruptDownload, srcFile.Name(), err)
+	}
+
+	tarball, err := b.newTarball(destFilename)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to create tarball: %w", err)
+	}
+	extractor, ok := format.(archiver.Extractor)
+	if !ok {
+		decompressor, ok := format.(archiver.Decompressor)
+		if !ok {
+			return nil, nil, 0, closeTarball(tarball, fmt.Errorf("%T is neither an archive nor compressed file: `%s`", format, srcFile.Name()))
+		}
+		err := appendCompressedBinary(ctx, tarball, decompressor, stream, release, stripPath)
+		if err := closeTarball(tarball, err); err != nil {
+			return nil, nil, 0, err
+		}
+		return tarball, format, 1, nil
+	}
+	regularFiles := 0
+	// errors other than those of the callback come from reading the archive
+	var handlerErr error
+	err = extractor.Extract(
+		ctx,
+		stream,
+		nil,
+		func(ctx context.Context, f archiver.File) (err error) {
+			defer func() { handlerErr = err }()
+			fileMode := f.Mode()
+			if !fileMode.IsRegular() && fileMode&os.ModeSymlink == 0 {
+				return nil
+			}
+			name := archiveEntryName(f.NameInArchive)
+			if !pathIncluded(release.Paths, name) {
+				return nil
+			}
+			log.Debug().Str("entry", name).Str("mode", fileMode.String()).Msg("adding release entry")
+			header := &tar.Header{
+				Name: strings.TrimPrefix(name, release.StripPrefix),
+				Mode: int64(f.Mode().Perm()),
+				Size: f.Size(),
+			}
+			if fileMode&os.ModeSymlink == 0 {
+				file, err := f.Open()
+				if err != nil {
+					return fmt.Errorf("%w: %w", errCorruptDownload, err)
+				}
+				defer file.Close()
+				reader := corruptReader{file}
+				regularFiles++
+				// zip archives may not record the binary as executable
+				if base := path.Base(header.Name); base == "piper" || base == "piper.exe" {
+					header.Mode |= 0o111
+					if stripPath != "" {
+						return appendStripped(ctx, tarball, header, reader, stripPath)
+					}
+				}
+				return tarball.Append(header, reader)
+			}
+			linkTarget, err := symlinkTarget(f)
+			if err != nil {
+				return fmt.Errorf("%w: %w", errCorruptDownload, err)
+			}
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = linkTarget
+			header.Size = 0
+			return tarball.Append(header, bytes.NewReader(nil))
+		},
+	)
+	if err != nil && (handlerErr == nil || !errors.Is(err, handlerErr)) && ctx.Err() == nil {
+		err = fmt.Errorf("%w: %w", errCorruptDownload, err)
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to extract piper: %w", err)
+	}
+	if err := closeTarball(tarball, err); err != nil {
+		return nil, nil, 0, err
+	}
+	return tarball, format, regularFiles, nil
+}
+
+type corruptReader struct {
+	r io.Reader
+}
+
+func (r corruptReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %w", errCorruptDownload, err)
+	}
+	return n, err
+}
+
+func appendCompressedBinary(ctx context.Context, tarball *Tarball, decompressor archiver.Decompressor, r io.Reader, release PiperRelease, stripPath string) error {
+	decompressed, err := decompressor.OpenReader(r)
+	if err != nil {
+		return fmt.Errorf("%w: failed to decompress piper: %w", errCorruptDownload, err)
+	}
+	defer decompressed.Close()
+	reader := corruptReader{decompressed}
+	tmp, err := os.CreateTemp("", "piper-gen-binary-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, reader)
+	if err != nil {
+		return fmt.Errorf("failed to decompress piper: %w", err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	name := "piper"
+	if release.OS == "windows" || strings.Contains(strings.ToLower(path.Base(release.URL)), ".exe.") {
+		name = "piper.exe"
+	}
+	log.Debug().Str("entry", name).Int64("size", size).Msg("adding decompressed release binary")
+	header := &tar.Header{Name: name, Mode: 0o755, Size: size}
+	if stripPath != "" {
+		return appendStripped(ctx, tarball, header, tmp, stripPath)
+	}
+	return tarball.Append(header, tmp)
+}
+
+func appendStripped(ctx context.Context, tarball *Tarball, header *tar.Header, r io.Reader, stripPath string) error {
+	tmp, err := os.CreateTemp("", "piper-gen-strip-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy binary: %w", err)
+	}
+	if err := run(ctx, "", nil, stripPath, tmp.Name()); err != nil {
+		log.Warn().Err(err).Str("entry", header.Name).Msg("failed to strip binary, keeping debug symbols")
+	}
+	stripped, err := os.Open(tmp.Name())
+	if err != nil {
+		return fmt.Errorf("failed to open stripped binary: %w", err)
+	}
+	defer stripped.Close()
+	info, err := stripped.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to read stripped binary info: %w", err)
+	}
+	log.Info().Str("entry", header.Name).Int64("size", header.Size).Int64("stripped_size", info.Size()).Msg("stripped binary")
+	header.Size = info.Size()
+	return tarball.Append(header, stripped)
+}
+
+func smokeTest(ctx context.Context, archiveFilename string) error {
+	dir, err := os.MkdirTemp("", "piper-gen-smoke-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	names, err := ExtractArchive(ctx, archiveFilename, dir, false, nil)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		name = archiveEntryName(name)
+		if base := path.Base(name); base == "piper" || base == "piper.exe" {
+			return run(ctx, dir, nil, filepath.Join(dir, filepath.FromSlash(name)), "--version")
+		}
+	}
+	return fmt.Errorf("no piper binary in %q", archiveFilename)
+}
+
+// PiperPackageName returns the name of the package generated for platform.
+func PiperPackageName(platform string) string {
+	return "piper-bin-" + platform
+}
+
+// InstallPiper generates the piper-bin-<platform> package from release.
+func (b *PackageBuilder) InstallPiper(ctx context.Context, platform, version string, release PiperRelease) (_ *Package, retErr error) {
+	version = cmp.Or(release.Version, version)
+	loc := PiperLocation(platform, release)
+	packageName, err := b.PackageName(loc)
+	if err != nil {
+		return nil, err
+	}
+	packagePath := b.modulePath(packageName)
+	if err := b.checkMajorVersion(version); err != nil {
+		return nil, err
+	}
+	pkgDir, err := b.PackageDir(loc)
+	if err != nil {
+		return nil, err
+	}
+	packageDirectory, commit, err := b.stagePackage(pkgDir)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { retErr = commit(retErr) }()
+	url := release.URL
+	var stripPath string
+	if b.Strip {
+		if release.OS != runtime.GOOS || runtime.GOOS == "windows" {
+			log.Info().Str("platform", platform).Msg("skipping strip of binary the host can't strip")
+		} else if stripPath, err = exec.LookPath("strip"); err != nil {
+			log.Warn().Err(err).Msg("strip not found, keeping debug symbols")
+		}
+	}
+
+	filename, err := b.Downloader.Download(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download piper: %w", err)
+	}
+	destFilename := filepath.Join(packageDirectory, b.archiveFilename())
+	var (
+		tarball      *Tarball
+		format       archiver.Format
+		regularFiles int
+	)
+	if err = b.Downloader.verifyCached(url); err == nil {
+		tarball, format, regularFiles, err = b.appendRelease(ctx, filename, destFilename, release, stripPath)
+	}
+	if errors.Is(err, errCorruptDownload) && ctx.Err() == nil && !b.Downloader.Offline {
+		// the download may have been truncated, so fetch it again once
+		log.Warn().Err(err).Str("url", url).Msg("release is corrupt, downloading it again")
+		if err := b.Downloader.Evict(url); err != nil {
+			return nil, err
+		}
+		if filename, err = b.Downloader.Download(ctx, url); err != nil {
+			return nil, fmt.Errorf("failed to download piper: %w", err)
+		}
+		tarball, format, regularFiles, err = b.appendRelease(ctx, filename, destFilename, release, stripPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if regularFiles == 0 {
+		return nil, fmt.Errorf("no files matching %q found in %q", release.Paths, url)
+	}
+	if b.SmokeTest {
+		if release.OS != runtime.GOOS || release.Arch != runtime.GOARCH {
+			log.Info().Str("platform", platform).Msg("skipping smoke test of binary for another platform")
+		} else if err := smokeTest(ctx, destFilename); err != nil {
+			return nil, fmt.Errorf("smoke test failed: %w", err)
+		}
+	}
+	assets := []packageAsset{{Var: "Asset", Name: platform}}
+	if err := b.writeGenerate(packageDirectory, packageIdentifier(platform), platform); err != nil {
+		return nil, fmt.Errorf("failed to write generate.go: %w", err)
+	}
+	meta, err := b.generatePackage(ctx, false, packageDirectory, packageIdentifier(platform), packagePath, assets, nil, Meta{
+		Version:      version,
+		Files:        tarball.Hashes(),
+		Sources:      []string{url},
+		SourceFormat: strings.TrimPrefix(format.Name(), "."),
+
+		UncompressedSize: tarball.UncompressedSize(),
+
+		ResolvedSources: b.Downloader.ResolvedURLs([]string{url}),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate package: %w", err)
+	}
+	return newPackage(KindBinary, packageName, packagePath, destFilename, meta)
+}
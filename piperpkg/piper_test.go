@@ -0,0 +1,176 @@
+package piperpkg
+
+import (
+	"archive/tar"
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestInstallPiperFormats(t *testing.T) {
+	// the fixtures hold the same release, in tar.bz2 with entries named
+	// like "./piper/piper"
+	tests := []struct {
+		filename string
+		format   string
+	}{
+		{"release.tar.gz", "tar.gz"},
+		{"release.tar.bz2", "tar.bz2"},
+		{"release.zip", "zip"},
+	}
+	wantContents := map[string]string{
+		"piper":                  "#!/bin/sh\necho piper\n",
+		"libpiper.so.1":          "library",
+		"libpiper.so":            "",
+		"espeak-ng-data/phontab": "phonemes",
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			b := &PackageBuilder{
+				Dir:        t.TempDir(),
+				Downloader: &Downloader{Dir: t.TempDir()},
+				SkipBuild:  true,
+			}
+			release := PiperRelease{
+				URL:         filepath.Join("testdata", tt.filename),
+				Paths:       []string{"piper"},
+				StripPrefix: "piper/",
+			}
+			if _, err := b.InstallPiper(context.Background(), "linux_amd64", "v1.0.0", release); err != nil {
+				t.Fatal(err)
+			}
+			pkgDir := filepath.Join(b.Dir, "piper-bin-linux_amd64")
+			headers, contents := readArchive(t, filepath.Join(pkgDir, "dist.tzst"))
+			if !maps.Equal(contents, wantContents) {
+				t.Errorf("archive has entries %q, want %q", contents, wantContents)
+			}
+			if h := headers["piper"]; h == nil || h.Mode != 0o755 {
+				t.Errorf("piper binary has header %+v", h)
+			}
+			if h := headers["libpiper.so"]; h == nil || h.Typeflag != tar.TypeSymlink || h.Linkname != "libpiper.so.1" {
+				t.Errorf("library symlink has header %+v", h)
+			}
+			meta := checkMeta(t, pkgDir, map[string]string{
+				"piper":                  wantContents["piper"],
+				"libpiper.so.1":          "library",
+				"espeak-ng-data/phontab": "phonemes",
+			}, "dist.tzst")
+			if meta.SourceFormat != tt.format {
+				t.Errorf("source format is %q, want %q", meta.SourceFormat, tt.format)
+			}
+		})
+	}
+}
+
+func TestExtractArchiveFormats(t *testing.T) {
+	for _, filename := range []string{"release.tar.gz", "release.tar.bz2", "release.zip"} {
+		t.Run(filename, func(t *testing.T) {
+			outDir := t.TempDir()
+			names, err := ExtractArchive(context.Background(), filepath.Join("testdata", filename), outDir, false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, name := range names {
+				names[i] = archiveEntryName(name)
+			}
+			slices.Sort(names)
+			want := []string{"piper/espeak-ng-data/phontab", "piper/libpiper.so", "piper/libpiper.so.1", "piper/piper"}
+			if !slices.Equal(names, want) {
+				t.Errorf("extracted %q, want %q", names, want)
+			}
+			if got := readFile(t, filepath.Join(outDir, "piper", "libpiper.so")); got != "library" {
+				t.Errorf("symlink resolves to %q", got)
+			}
+			info, err := os.Stat(filepath.Join(outDir, "piper", "piper"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm()&0o111 == 0 {
+				t.Errorf("piper binary has mode %v", info.Mode())
+			}
+		})
+	}
+}
+
+func TestInstallPiperCorruptRelease(t *testing.T) {
+	const urlPath = "/releases/piper_linux_x86_64.tar.gz"
+	release := testTarGz(t, testRelease)
+	duplicate := testTarGz(t, append(slices.Clone(testRelease), testEntry{Name: "piper/piper", Body: "again", Mode: 0o755}))
+	tests := []struct {
+		name string
+		// served is the release served, and cached, if set, what the
+		// cached download is replaced with after a first install.
+		served []byte
+		cached []byte
+		// wantHits is the number of downloads, and wantErr part of the
+		// error expected, if any.
+		wantHits int
+		wantErr  string
+	}{
+		{
+			name:     "truncated cache",
+			served:   release,
+			cached:   release[:len(release)/2],
+			wantHits: 2,
+		},
+		{
+			// readable, so only caught by checking the hash
+			name:     "modified cache",
+			served:   release,
+			cached:   duplicate,
+			wantHits: 2,
+		},
+		{
+			name:     "truncated download",
+			served:   release[:len(release)/2],
+			wantHits: 2,
+			wantErr:  "corrupt download",
+		},
+		{
+			name:     "duplicate entry",
+			served:   duplicate,
+			wantHits: 1,
+			wantErr:  `duplicate entry "piper"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFixtureServer(t, map[string][]byte{urlPath: tt.served})
+			b := newTestBuilder(t, s)
+			release := PiperRelease{
+				URL:         s.URL + urlPath,
+				Paths:       []string{"piper"},
+				StripPrefix: "piper/",
+			}
+			ctx := context.Background()
+			if tt.cached != nil {
+				if _, err := b.InstallPiper(ctx, "linux_amd64", "v1.0.0", release); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(cacheFilename(b.Downloader.Dir, release.URL), tt.cached, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := b.InstallPiper(ctx, "linux_amd64", "v1.0.0", release)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+			if hits := s.requests(urlPath); hits != tt.wantHits {
+				t.Errorf("release was downloaded %d times, want %d", hits, tt.wantHits)
+			}
+			if tt.wantErr == "" {
+				_, contents := readArchive(t, filepath.Join(b.Dir, "piper-bin-linux_amd64", "dist.tzst"))
+				if contents["piper"] != "#!/bin/sh\necho piper\n" {
+					t.Errorf("archive has entries %q", contents)
+				}
+			}
+		})
+	}
+}
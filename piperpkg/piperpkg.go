@@ -0,0 +1,871 @@
+// Package piperpkg generates Go modules that embed piper voices and binaries
+// for use with github.com/piper-tts-go/piper.
+package piperpkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ArchiveFilename  = "dist.tzst"
+	MetadataFilename = "dist.json"
+
+	// AssetModulePath is the module imported by every generated package.
+	AssetModulePath = "github.com/piper-tts-go/piper-go-asset"
+)
+
+// PackageBuilder generates packages into Dir.
+type PackageBuilder struct {
+	// Dir is the directory packages are generated into.
+	Dir string
+	// Downloader fetches the files packaged.
+	Downloader *Downloader
+	// SkipBuild skips running `go mod tidy` and `go build` in generated packages.
+	SkipBuild bool
+	// Mode is ModeEmbed, the default, or ModeLazy to generate packages that
+	// download their archive from LazyURL on first use instead of embedding it.
+	Mode string
+	// LazyURL is the base URL archives are published under in ModeLazy, as
+	// LazyURL/<package>/<version>/<archive>.
+	LazyURL string
+	// Strip removes debug symbols from piper binaries for the host's OS with
+	// the strip program, if it's installed.
+	Strip bool
+	// SmokeTest runs the piper binary of packages for the host platform
+	// before accepting them.
+	SmokeTest bool
+	// KeepOnError preserves the directory of a package that failed to generate.
+	KeepOnError bool
+	// TidyRetries is how many times to retry `go mod tidy` after a network
+	// error.
+	TidyRetries int
+	// SkipTidy builds generated packages with `go build -mod=mod` instead of
+	// running `go mod tidy` first, and writes their go.sum, so no module is
+	// resolved over the network. It needs AssetVersion, and a Replace of
+	// AssetModulePath or a module cache holding it.
+	SkipTidy bool
+	// GoEnv, if not nil, overrides environment variables of the go commands
+	// building generated packages, e.g. with DefaultGoEnv, so builds don't
+	// depend on the GOFLAGS, GOPROXY etc. of the host. An empty value clears
+	// the variable.
+	GoEnv map[string]string
+	// WarnArchiveSize and MaxArchiveSize, if not 0, are the sizes in bytes of
+	// an embedded archive above which generating its package logs a warning
+	// or fails. Lazy packages don't embed their archive.
+	WarnArchiveSize int64
+	MaxArchiveSize  int64
+	// Incremental keeps an existing voice package whose files are unchanged
+	// instead of regenerating it. Otherwise, voice archives compress every
+	// file in its own frame, and those of files unchanged since the existing
+	// package are copied rather than compressed again.
+	Incremental bool
+	// AssetVersion pins the version of AssetModulePath required by generated
+	// packages. When empty, `go mod tidy` resolves the latest version.
+	AssetVersion string
+	// ArchiveFilename and MetadataFilename override the names of the
+	// embedded archive and metadata files.
+	ArchiveFilename  string
+	MetadataFilename string
+	// ArchiveFormat is the key in ArchiveFormats of the format used for the
+	// embedded archive, "tzst" by default.
+	ArchiveFormat string
+	// Perms forces the permissions of archive entries.
+	Perms TarPerms
+	// TarFormat, if known, forces the format of archive headers, failing
+	// for entries it can't represent.
+	TarFormat tar.Format
+	// Manifest ends archives with a ManifestFilename entry listing the size
+	// and hash of every other file.
+	Manifest bool
+	// StrictCompression fails when the archive's encoder can't be created
+	// with the format's options, instead of falling back to its defaults.
+	StrictCompression bool
+	// License replaces the LICENSE of generated packages. When empty, it's
+	// the MIT License with the Copyright holders, prefixed in voice packages
+	// by a note that the voice data is under the terms of its model card.
+	License string
+	// Copyright lists the copyright lines of the default license, e.g.
+	// "2025 Jane Doe". DefaultCopyright is used when empty.
+	Copyright []string
+	// MajorVersion, if 2 or more, is the major version of generated
+	// modules, appended to their path as "/vN". If set, package versions
+	// must be at this major version.
+	MajorVersion int
+	// Replace adds replace directives to the go.mod of generated packages,
+	// mapping module paths to a local directory or to "path@version".
+	Replace map[string]string
+	// Layout, if set, gives the directory under Dir of each package from
+	// its PackageLocation. Packages are generated directly under Dir, in a
+	// directory named after the package, by default.
+	Layout *template.Template
+	// VoiceName and BinName, if set, give the names of voice and binary
+	// packages from their PackageLocation, in place of the default
+	// piper-voice-<name>-<quality> and piper-bin-<platform>.
+	VoiceName *template.Template
+	BinName   *template.Template
+	// ModelCardSidecar leaves a voice's MODEL_CARD out of the archive, so it's
+	// only embedded as the MODEL_CARD.txt next to it.
+	ModelCardSidecar bool
+	// CompressModelCard stores the MODEL_CARD.txt next to the archive
+	// gzipped, as MODEL_CARD.txt.gz, and generates a ModelCard function
+	// returning its text.
+	CompressModelCard bool
+	// VoiceConfigGo writes a config.go into voice packages, with a Config
+	// func returning the voice.json as a Go value.
+	VoiceConfigGo bool
+	// Command, if not nil, is the piper-gen command line without -dir and -only
+	// recorded in a go:generate directive of each package so it can be
+	// regenerated in place. It must not contain secrets.
+	Command []string
+	// EntryName, if set, returns the name in a voice's tarball of the file
+	// at url, or "" to use the default: voice.onnx, voice.json or
+	// MODEL_CARD depending on the file.
+	EntryName func(url string) string
+	// PhonemizerData is a URL or local path of espeak-ng data (a directory
+	// or an archive) to bundle into voice packages under PhonemizerDataDir.
+	PhonemizerData string
+}
+
+// DefaultCopyright is the copyright of the default license.
+var DefaultCopyright = []string{"2023 Amity Bell", "2025 Dharma Bellamkonda"}
+
+func (b *PackageBuilder) license(voicePkg bool, dataLicense string) []byte {
+	if b.License != "" {
+		return []byte(b.License)
+	}
+	lines := b.Copyright
+	if len(lines) == 0 {
+		lines = DefaultCopyright
+	}
+	copyright := ""
+	for _, line := range lines {
+		copyright += "Copyright (c) " + line + "\n"
+	}
+	license := "\nMIT License\n\n" + copyright + `
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+`
+	if voicePkg {
+		license = "\nThe voice data in this package is licensed under the terms given in\n" + dataLicense +
+			".\n\nThe Go source files are licensed as follows:\n" + license
+	}
+	return []byte(license)
+}
+
+func (b *PackageBuilder) newTarball(filename string) (*Tarball, error) {
+	return b.newFramedTarball(filename, false)
+}
+
+func (b *PackageBuilder) newFramedTarball(filename string, framed bool) (*Tarball, error) {
+	format := b.archiveFormat()
+	tarball, err := newTarballFile(filename, format, b.Perms, framed)
+	if errors.Is(err, errEncoder) && !b.StrictCompression && format.NewFallbackEncoder != nil {
+		log.Warn().Err(err).Str("compression", format.Compression).Msg("falling back to default compression options")
+		format.NewEncoder = format.NewFallbackEncoder
+		tarball, err = newTarballFile(filename, format, b.Perms, framed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tarball.headerFormat = b.TarFormat
+	tarball.manifest = b.Manifest
+	return tarball, nil
+}
+
+func (b *PackageBuilder) newVoiceTarball(filename, pkgDir string) (*Tarball, error) {
+	tarball, err := b.newFramedTarball(filename, b.Incremental)
+	if err != nil || !b.Incremental {
+		return tarball, err
+	}
+	meta, ok := b.existingMeta(pkgDir)
+	if !ok || len(meta.Members) == 0 || meta.Compression != b.archiveFormat().Compression {
+		return tarball, nil
+	}
+	if err := tarball.reusePrevious(filepath.Join(pkgDir, b.archiveFilename()), meta.Members); err != nil {
+		log.Warn().Err(err).Str("dir", pkgDir).Msg("compressing every file of the voice again")
+	}
+	return tarball, nil
+}
+
+func (b *PackageBuilder) archiveFormat() ArchiveFormat {
+	if format, ok := ArchiveFormats[b.ArchiveFormat]; ok {
+		return format
+	}
+	return ArchiveFormats["tzst"]
+}
+
+func (b *PackageBuilder) archiveFilename() string {
+	if b.ArchiveFilename == "" {
+		return b.defaultArchiveFilename()
+	}
+	return b.ArchiveFilename
+}
+
+func (b *PackageBuilder) defaultArchiveFilename() string {
+	return "dist" + b.archiveFormat().Extension
+}
+
+func (b *PackageBuilder) metadataFilename() string {
+	if b.MetadataFilename == "" {
+		return MetadataFilename
+	}
+	return b.MetadataFilename
+}
+
+// Check reports an error if the archive format or file names are invalid.
+func (b *PackageBuilder) Check() error {
+	if _, ok := ArchiveFormats[b.ArchiveFormat]; !ok && b.ArchiveFormat != "" {
+		return fmt.Errorf("unsupported archive format %q", b.ArchiveFormat)
+	}
+	for _, name := range []string{b.archiveFilename(), b.metadataFilename()} {
+		if name != filepath.Base(name) {
+			return fmt.Errorf("archive and metadata filenames must be plain file names, got %q", name)
+		}
+	}
+	if b.archiveFilename() == b.metadataFilename() {
+		return errors.New("archive and metadata filenames must differ")
+	}
+	if b.MajorVersion < 0 {
+		return fmt.Errorf("invalid major version %d", b.MajorVersion)
+	}
+	if b.SkipTidy && b.AssetVersion == "" {
+		return errors.New("skipping go mod tidy needs the asset module version")
+	}
+	switch b.Mode {
+	case "", ModeEmbed:
+	case ModeLazy:
+		if b.LazyURL == "" {
+			return errors.New("lazy packages need a URL to download archives from")
+		}
+	default:
+		return fmt.Errorf("unsupported mode %q", b.Mode)
+	}
+	return nil
+}
+
+func (b *PackageBuilder) checkArchiveSize(pkgPath string, size int64) error {
+	if b.MaxArchiveSize > 0 && size > b.MaxArchiveSize {
+		return fmt.Errorf("archive of %s is %d bytes, more than the limit of %d; use lazy mode to download it at run time", pkgPath, size, b.MaxArchiveSize)
+	}
+	if b.WarnArchiveSize > 0 && size > b.WarnArchiveSize {
+		log.Warn().Str("package", pkgPath).Int64("size", size).Int64("threshold", b.WarnArchiveSize).Msg("embedded archive is large and will bloat every binary importing it; consider lazy mode")
+	}
+	return nil
+}
+
+// GoVersion returns the version of the go toolchain on PATH, which builds
+// generated packages.
+func GoVersion(ctx context.Context) (string, error) {
+	goPath, err := exec.LookPath("go")
+	if err != nil {
+		return "", err
+	}
+	out, err := exec.CommandContext(ctx, goPath, "env", "GOVERSION").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run %s: %w", goPath, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// EnclosingModule returns the go.mod of the module containing dir, if any.
+// Generated packages are modules of their own, but a go.mod or go.work
+// above dir can still confuse tools run on them.
+func EnclosingModule(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %q: %w", dir, err)
+	}
+	for {
+		for _, name := range []string{"go.mod", "go.work"} {
+			filename := filepath.Join(dir, name)
+			if _, err := os.Stat(filename); err == nil {
+				return filename, nil
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+func (b *PackageBuilder) stagePackage(pkgDir string) (string, func(error) error, error) {
+	if err := os.MkdirAll(filepath.Dir(pkgDir), 0o755); err != nil {
+		return "", nil, fmt.Errorf("failed to create %q: %w", filepath.Dir(pkgDir), err)
+	}
+	stageDir, err := os.MkdirTemp(filepath.Dir(pkgDir), "."+filepath.Base(pkgDir)+".*.tmp")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	commit := func(err error) error {
+		if err == nil {
+			if err := os.RemoveAll(pkgDir); err != nil {
+				os.RemoveAll(stageDir)
+				return fmt.Errorf("failed to remove previous package %q: %w", pkgDir, err)
+			}
+			if err := os.Rename(stageDir, pkgDir); err != nil {
+				os.RemoveAll(stageDir)
+				return fmt.Errorf("failed to move package into %q: %w", pkgDir, err)
+			}
+			return nil
+		}
+		if b.KeepOnError {
+			failedDir := pkgDir + ".failed"
+			os.RemoveAll(failedDir)
+			if renameErr := os.Rename(stageDir, failedDir); renameErr != nil {
+				failedDir = stageDir
+			}
+			log.Warn().Str("dir", failedDir).Msg("keeping failed package directory")
+			return err
+		}
+		if removeErr := os.RemoveAll(stageDir); removeErr != nil {
+			log.Warn().Err(removeErr).Str("dir", stageDir).Msg("failed to remove failed package directory")
+		}
+		return err
+	}
+	return stageDir, commit, nil
+}
+
+type packageAsset struct {
+	// Var is the name of the Go variable.
+	Var string
+	// Name is the Asset's name.
+	Name string
+	// Dir is the directory within the archive holding the asset's files,
+	// or empty if they're at the root.
+	Dir string
+	// Base is the Asset holding the files listed in Meta.Shared, or empty.
+	Base string
+}
+
+type packageDep struct {
+	// Ident is the identifier the package is imported as.
+	Ident string
+	// Path and Version are the module path and version to require.
+	Path    string
+	Version string
+	// Dir is the package's local directory, used to build before it's published.
+	Dir string
+}
+
+func (b *PackageBuilder) generatePackage(ctx context.Context, voicePkg bool, pkgDir, embedPkgName, pkgPath string, assets []packageAsset, deps []packageDep, meta Meta, embedPaths ...string) (_ Meta, retErr error) {
+	defer func() {
+		if retErr != nil {
+			retErr = fmt.Errorf("%s (%s): %w", pkgPath, pkgDir, retErr)
+		}
+	}()
+
+	embedPaths = append([]string{
+		b.archiveFilename(),
+		b.metadataFilename(),
+	}, embedPaths...)
+	for _, p := range embedPaths {
+		// the metadata is written last, once the other files are hashed
+		if p == b.metadataFilename() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(pkgDir, filepath.FromSlash(p))); err != nil {
+			return Meta{}, fmt.Errorf("embedded file %q is missing: %w", p, err)
+		}
+	}
+
+	lazy := b.Mode == ModeLazy
+	directivePaths := embedPaths
+	assetFS := "fs"
+	if lazy {
+		directivePaths = embedPaths[1:]
+		assetFS = "lazyFS{fs}"
+	}
+
+	assetDecls := ""
+	usesAssetFS := false
+	for _, a := range assets {
+		fsExpr, custom := b.assetFSExpr(a, assetFS)
+		usesAssetFS = usesAssetFS || custom
+		assetDecls += "\n\t" + a.Var + " = asset.Asset{Name: " + strconv.Quote(a.Name) + ", FS: " + fsExpr + "}"
+	}
+	constDecls := ""
+	if meta.PhonemizerData != "" {
+		constDecls = "\n// PhonemizerData is the directory of the archive holding espeak-ng data.\nconst PhonemizerData = " + strconv.Quote(meta.PhonemizerData) + "\n"
+	}
+	depImports := ""
+	for _, dep := range deps {
+		depImports += "\n\t" + dep.Ident + " " + strconv.Quote(dep.Path)
+	}
+	funcDecls := ""
+	for _, p := range embedPaths {
+		if path.Base(p) == compressedModelCard {
+			funcDecls = modelCardFunc(path.Dir(p) != ".")
+			depImports = "\n\t\"compress/gzip\"\n\t\"io\"" + depImports
+			break
+		}
+	}
+
+	embedGo, err := format.Source([]byte(`// GENERATED FILE
+
+package ` + embedPkgName + `
+
+import (
+	"embed"
+	"` + AssetModulePath + `"` + depImports + `
+)
+var (
+	//go:embed ` + strings.Join(directivePaths, " ") + `
+	fs embed.FS
+` + assetDecls + `
+)
+` + constDecls + funcDecls))
+	if err != nil {
+		return Meta{}, fmt.Errorf("failed to format embed.go: %w", err)
+	}
+	goMod := []byte(`
+module ` + pkgPath + `
+
+go 1.21
+
+`)
+	if b.AssetVersion != "" {
+		goMod = append(goMod, "require "+AssetModulePath+" "+b.AssetVersion+"\n"...)
+	}
+	if lazy {
+		goMod = append(goMod, "require "+xxh3Module+" "+xxh3Version+"\n"...)
+	}
+	for _, dep := range deps {
+		rel, err := filepath.Rel(pkgDir, dep.Dir)
+		if err != nil {
+			return Meta{}, fmt.Errorf("failed to locate %s: %w", dep.Path, err)
+		}
+		goMod = append(goMod, "require "+dep.Path+" "+dep.Version+"\n"...)
+		goMod = append(goMod, "replace "+dep.Path+" => "+filepath.ToSlash(rel)+"\n"...)
+	}
+	for _, old := range slices.Sorted(maps.Keys(b.Replace)) {
+		replacement := b.Replace[old]
+		if mod, version, ok := strings.Cut(replacement, "@"); ok {
+			replacement = mod + " " + version
+		} else {
+			// local paths are relative to the generated package otherwise
+			abs, err := filepath.Abs(replacement)
+			if err != nil {
+				return Meta{}, fmt.Errorf("failed to resolve replacement of %s: %w", old, err)
+			}
+			replacement = filepath.ToSlash(abs)
+		}
+		goMod = append(goMod, "replace "+old+" => "+replacement+"\n"...)
+	}
+
+	distLicense := "https://github.com/piper-tts-go/piper"
+	dataLicense := ""
+	if voicePkg {
+		// voices without a MODEL_CARD fall back to the upstream repository's terms
+		distLicense = "https://huggingface.co/rhasspy/piper-voices"
+		dataLicense = distLicense
+		var modelCards, modelCardLinks []string
+		for _, p := range embedPaths {
+			if base := path.Base(p); base == "MODEL_CARD.txt" || base == compressedModelCard {
+				modelCards = append(modelCards, p)
+				modelCardLinks = append(modelCardLinks, "["+p+"]("+p+")")
+			}
+		}
+		if len(modelCards) != 0 {
+			distLicense = strings.Join(modelCardLinks, ", ")
+			dataLicense = strings.Join(modelCards, ", ")
+		}
+	}
+
+	archiveURL := ""
+	lazyNote := ""
+	if lazy {
+		archiveURL = b.lazyURL(pkgPath, meta.Version)
+		lazyNote = "- " + b.archiveFilename() + " is downloaded on first use from " + archiveURL + "\n"
+	}
+	readmeMd := []byte(`
+Package auto-generated by https://github.com/piper-tts-go/piper-gen
+
+- Package license: See [LICENSE](LICENSE)
+- ` + b.archiveFilename() + ` license: See ` + distLicense + `
+` + lazyNote + `- See https://github.com/piper-tts-go/piper for docs
+`)
+
+	if err := writeFileAtomic(filepath.Join(pkgDir, "embed.go"), embedGo, 0o644); err != nil {
+		return Meta{}, err
+	}
+	if err := writeFileAtomic(filepath.Join(pkgDir, "go.mod"), goMod, 0o644); err != nil {
+		return Meta{}, err
+	}
+	if b.SkipTidy {
+		if err := b.writeGoSum(ctx, pkgDir, deps, lazy); err != nil {
+			return Meta{}, fmt.Errorf("failed to write go.sum: %w", err)
+		}
+	}
+	if err := writeFileAtomic(filepath.Join(pkgDir, "README.md"), readmeMd, 0o644); err != nil {
+		return Meta{}, err
+	}
+	if err := writeFileAtomic(filepath.Join(pkgDir, "LICENSE"), b.license(voicePkg, dataLicense), 0o644); err != nil {
+		return Meta{}, err
+	}
+	meta.Compression = b.archiveFormat().Compression
+	archiveInfo, err := os.Stat(filepath.Join(pkgDir, b.archiveFilename()))
+	if err != nil {
+		return Meta{}, fmt.Errorf("failed to stat archive: %w", err)
+	}
+	meta.ArchiveSize = archiveInfo.Size()
+	if !lazy {
+		if err := b.checkArchiveSize(pkgPath, meta.ArchiveSize); err != nil {
+			return Meta{}, err
+		}
+	}
+	// the hash covers every embedded file but the metadata itself
+	hashedFiles := slices.DeleteFunc(slices.Clone(embedPaths), func(name string) bool {
+		return name == b.metadataFilename()
+	})
+	meta, err = InstallMeta(filepath.Join(pkgDir, b.metadataFilename()), meta, pkgDir, hashedFiles...)
+	if err != nil {
+		return Meta{}, err
+	}
+	if err := b.writeAssetFS(pkgDir, embedPkgName, usesAssetFS); err != nil {
+		return Meta{}, fmt.Errorf("failed to write assetfs.go: %w", err)
+	}
+	if lazy {
+		// written once the hash is known, which it isn't part of
+		if err := b.writeLazy(pkgDir, embedPkgName, archiveURL, meta, hashedFiles); err != nil {
+			return Meta{}, fmt.Errorf("failed to write lazy.go: %w", err)
+		}
+		log.Info().Str("url", archiveURL).Str("package", pkgPath).Msg("archive must be published for lazy package")
+	}
+	if b.SkipBuild {
+		return meta, nil
+	}
+	buildArgs := []string{"build", "."}
+	if b.SkipTidy {
+		buildArgs = []string{"build", "-mod=mod", "."}
+	} else if err := b.tidy(ctx, pkgDir); err != nil {
+		logGeneratedFiles(pkgDir)
+		return Meta{}, err
+	}
+	if b.AssetVersion != "" {
+		if err := checkRequire(pkgDir, AssetModulePath, b.AssetVersion); err != nil {
+			return Meta{}, err
+		}
+	}
+	if err := run(ctx, pkgDir, b.goEnv(), "go", buildArgs...); err != nil {
+		logGeneratedFiles(pkgDir)
+		return Meta{}, err
+	}
+	return meta, nil
+}
+
+func (b *PackageBuilder) writeGenerate(pkgDir, embedPkgName string, only ...string) error {
+	if b.Command == nil {
+		return nil
+	}
+	dir, err := filepath.Rel(pkgDir, b.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to locate %q: %w", b.Dir, err)
+	}
+	version := ToolVersion()
+	if version == "(devel)" {
+		version = "latest"
+	}
+	args := []string{"go", "run", "github.com/piper-tts-go/piper-gen@" + version, "-dir=" + filepath.ToSlash(dir)}
+	if len(only) != 0 {
+		args = append(args, "-only="+strings.Join(only, ","))
+	}
+	for _, arg := range b.Command {
+		if strings.ContainsAny(arg, " \t\"") {
+			arg = strconv.Quote(arg)
+		}
+		args = append(args, arg)
+	}
+	generateGo := "// GENERATED FILE\n\npackage " + embedPkgName + "\n\n//go:generate " + strings.Join(args, " ") + "\n"
+	return writeFileAtomic(filepath.Join(pkgDir, "generate.go"), []byte(generateGo), 0o644)
+}
+
+// UpToDate reports whether the package at loc was generated at version.
+func (b *PackageBuilder) UpToDate(loc PackageLocation, version string) bool {
+	pkgDir, err := b.PackageDir(loc)
+	if err != nil {
+		return false
+	}
+	meta, ok := b.existingMeta(pkgDir)
+	return ok && meta.Version == version
+}
+
+func (b *PackageBuilder) existingMeta(pkgDir string) (Meta, bool) {
+	src, err := os.ReadFile(filepath.Join(pkgDir, b.metadataFilename()))
+	if err != nil {
+		return Meta{}, false
+	}
+	var meta Meta
+	if err := json.Unmarshal(src, &meta); err != nil {
+		log.Warn().Err(err).Str("dir", pkgDir).Msg("failed to read existing metadata")
+		return Meta{}, false
+	}
+	return meta, true
+}
+
+func (b *PackageBuilder) unchanged(pkgDir, version string, hashes map[string]Hash) (Meta, bool) {
+	meta, ok := b.existingMeta(pkgDir)
+	if !ok || meta.Version != version || meta.Compression != b.archiveFormat().Compression {
+		return Meta{}, false
+	}
+	if _, err := os.Stat(filepath.Join(pkgDir, b.archiveFilename())); err != nil {
+		return Meta{}, false
+	}
+	old := maps.Clone(meta.Files)
+	if old == nil {
+		old = map[string]Hash{}
+	}
+	maps.Copy(old, meta.Shared)
+	if _, ok := old[ManifestFilename]; ok != b.Manifest {
+		return Meta{}, false
+	}
+	delete(old, ManifestFilename)
+	return meta, maps.Equal(old, hashes)
+}
+
+func checkRequire(pkgDir, modPath, version string) error {
+	src, err := os.ReadFile(filepath.Join(pkgDir, "go.mod"))
+	if err != nil {
+		return fmt.Errorf("failed to read go.mod: %w", err)
+	}
+	for _, line := range strings.Split(string(src), "\n") {
+		fields := strings.Fields(strings.TrimPrefix(strings.TrimSpace(line), "require"))
+		if len(fields) >= 2 && fields[0] == modPath {
+			if fields[1] != version {
+				return fmt.Errorf("go.mod requires %s %s, expected %s", modPath, fields[1], version)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("go.mod does not require %s", modPath)
+}
+
+func logGeneratedFiles(pkgDir string) {
+	for _, name := range []string{"embed.go", "go.mod"} {
+		src, err := os.ReadFile(filepath.Join(pkgDir, name))
+		if err != nil {
+			continue
+		}
+		log.Debug().Str("dir", pkgDir).Str("file", name).Str("contents", string(src)).Msg("generated file")
+	}
+}
+
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return renameFile(tmp.Name(), filename)
+}
+
+var renameFile = os.Rename
+
+func copyFile(dest, src string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %w", src, err)
+	}
+	defer srcFile.Close()
+
+	destFile, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("failed to create %q: %w", dest, err)
+	}
+	_, copyErr := io.Copy(destFile, srcFile)
+	closeErr := destFile.Close()
+	if copyErr != nil {
+		return fmt.Errorf("failed to copy %q to %q: %w", src, dest, copyErr)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("failed to close %q: %w", dest, closeErr)
+	}
+	return nil
+}
+
+func packageIdentifier(name string) string {
+	ident := strings.Map(func(r rune) rune {
+		if r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, name)
+	if ident == "" || !unicode.IsLetter([]rune(ident)[0]) {
+		ident = "pkg_" + ident
+	}
+	if token.IsKeyword(ident) {
+		ident += "_"
+	}
+	return ident
+}
+
+func checkModulePathElement(elem string) error {
+	if elem == "" {
+		return errors.New("empty module path element")
+	}
+	for _, r := range elem {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || strings.ContainsRune("-._~", r)) {
+			return fmt.Errorf("invalid character %q in module path element %q", r, elem)
+		}
+	}
+	if elem[0] == '.' || elem[len(elem)-1] == '.' {
+		return fmt.Errorf("module path element %q must not begin or end with a dot", elem)
+	}
+	return nil
+}
+
+type lineLogger struct {
+	program string
+	partial []byte
+}
+
+func (ll *lineLogger) Write(p []byte) (int, error) {
+	ll.partial = append(ll.partial, p...)
+	for {
+		i := bytes.IndexByte(ll.partial, '\n')
+		if i < 0 {
+			break
+		}
+		ll.log(ll.partial[:i])
+		ll.partial = ll.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush logs any trailing output not terminated by a newline.
+func (ll *lineLogger) Flush() {
+	if len(ll.partial) != 0 {
+		ll.log(ll.partial)
+		ll.partial = nil
+	}
+}
+
+func (ll *lineLogger) log(line []byte) {
+	log.Debug().Str("program", ll.program).Msg(string(bytes.TrimRight(line, "\r")))
+}
+
+var transientGoErrors = []string{
+	"dial tcp",
+	"i/o timeout",
+	"connection reset by peer",
+	"connection refused",
+	"TLS handshake timeout",
+	"unexpected EOF",
+	"temporary failure in name resolution",
+	"502 Bad Gateway",
+	"503 Service Unavailable",
+	"504 Gateway Timeout",
+}
+
+func isTransientGoError(err error) bool {
+	msg := err.Error()
+	for _, s := range transientGoErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultGoEnv pins the go settings that change how generated packages are
+// resolved and built.
+var DefaultGoEnv = map[string]string{
+	"GOFLAGS":     "",
+	"GOPROXY":     "https://proxy.golang.org,direct",
+	"GOSUMDB":     "sum.golang.org",
+	"GONOSUMDB":   "",
+	"GONOPROXY":   "",
+	"GOPRIVATE":   "",
+	"CGO_ENABLED": "0",
+}
+
+func (b *PackageBuilder) goEnv() []string {
+	// build generated packages on their own, even inside a workspace
+	env := append(os.Environ(), "GOWORK=off")
+	for _, key := range slices.Sorted(maps.Keys(b.GoEnv)) {
+		env = append(env, key+"="+b.GoEnv[key])
+	}
+	return env
+}
+
+func (b *PackageBuilder) tidy(ctx context.Context, pkgDir string) error {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := run(ctx, pkgDir, b.goEnv(), "go", "mod", "tidy")
+		if err == nil || attempt > b.TidyRetries || ctx.Err() != nil || !isTransientGoError(err) {
+			return err
+		}
+		log.Warn().Err(err).Int("attempt", attempt).Dur("delay", delay).Msg("go mod tidy hit a network error, retrying")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func run(ctx context.Context, workingDirectory string, env []string, program string, args ...string) error {
+	stderr := bytes.NewBuffer(nil)
+	output := &lineLogger{program: program}
+	defer output.Flush()
+	cmd := exec.CommandContext(ctx, program, args...)
+	cmd.Stderr = io.MultiWriter(stderr, output)
+	cmd.Stdout = cmd.Stderr
+	cmd.Dir = workingDirectory
+	cmd.Env = env
+	log.Info().Str("program", program).Strs("args", args).Msg("running executable command")
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to run `%s %s`: %w: %s", program, strings.Join(args, " "), err, stderr.Bytes())
+	}
+	return nil
+}
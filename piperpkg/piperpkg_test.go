@@ -0,0 +1,579 @@
+package piperpkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/zeebo/xxh3"
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+// fixtureServer serves files by path and counts the requests for each.
+type fixtureServer struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	files map[string][]byte
+	hits  map[string]int
+	// gate, if set, holds back responses until it's closed.
+	gate chan struct{}
+}
+
+func newFixtureServer(t *testing.T, files map[string][]byte) *fixtureServer {
+	t.Helper()
+	s := &fixtureServer{files: files, hits: map[string]int{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		data, ok := s.files[r.URL.Path]
+		if r.Method == http.MethodGet {
+			s.hits[r.URL.Path]++
+		}
+		gate := s.gate
+		s.mu.Unlock()
+		if gate != nil {
+			<-gate
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// requests returns the number of GET requests for urlPath.
+func (s *fixtureServer) requests(urlPath string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits[urlPath]
+}
+
+// set serves data at urlPath.
+func (s *fixtureServer) set(urlPath string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[urlPath] = data
+}
+
+// testMinSizes are the MinSizes of test Downloaders, which accept testONNX.
+var testMinSizes = map[string]int64{"": 1, ".onnx": 1 << 10}
+
+// testONNX returns a fake voice model just large enough to pass testMinSizes.
+func testONNX() []byte {
+	data := make([]byte, testMinSizes[".onnx"])
+	data[0] = 0x08
+	return data
+}
+
+const testVoiceJSON = `{
+	"dataset": "test",
+	"audio": {"sample_rate": 22050, "quality": "low"},
+	"language": {"code": "en_GB", "name_english": "English", "country_english": "Great Britain"},
+	"num_speakers": 1
+}`
+
+const testModelCard = "# Model card for test\n\nLicense: CC0\n"
+
+// testVoiceFiles returns the files of the fake voice en_GB-test-low as
+// served under /voices.
+func testVoiceFiles() map[string][]byte {
+	return map[string][]byte{
+		"/voices/en_GB-test-low.onnx":      testONNX(),
+		"/voices/en_GB-test-low.onnx.json": []byte(testVoiceJSON),
+		"/voices/MODEL_CARD":               []byte(testModelCard),
+	}
+}
+
+// newTestBuilder returns a PackageBuilder generating into a temporary
+// directory without building, downloading through s.
+func newTestBuilder(t *testing.T, s *fixtureServer) *PackageBuilder {
+	t.Helper()
+	return &PackageBuilder{
+		Dir:        t.TempDir(),
+		Downloader: &Downloader{Dir: t.TempDir(), Client: s.Client(), MinSizes: testMinSizes},
+		SkipBuild:  true,
+	}
+}
+
+func readFile(t *testing.T, filename string) string {
+	t.Helper()
+	src, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(src)
+}
+
+func TestInstallVoiceModelCard(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		// modelCard is whether MODEL_CARD.txt is expected, and license
+		// and docLicense where the README and doc.go point to for the
+		// voice's license.
+		modelCard  bool
+		license    string
+		docLicense string
+	}{
+		{
+			name:       "with model card",
+			files:      []string{"en_GB-test-low.onnx", "en_GB-test-low.onnx.json", "MODEL_CARD"},
+			modelCard:  true,
+			license:    "[MODEL_CARD.txt](MODEL_CARD.txt)",
+			docLicense: "MODEL_CARD.txt",
+		},
+		{
+			name:       "without model card",
+			files:      []string{"en_GB-test-low.onnx", "en_GB-test-low.onnx.json"},
+			license:    "https://huggingface.co/rhasspy/piper-voices",
+			docLicense: "https://huggingface.co/rhasspy/piper-voices",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFixtureServer(t, testVoiceFiles())
+			b := newTestBuilder(t, s)
+			var urls []string
+			for _, name := range tt.files {
+				urls = append(urls, s.URL+"/voices/"+name)
+			}
+			pkg, err := b.InstallVoice(context.Background(), VoiceSpec{Name: "test", URLs: urls}, "v1.0.0", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pkgDir := filepath.Join(b.Dir, pkg.Name)
+
+			_, err = os.Stat(filepath.Join(pkgDir, "MODEL_CARD.txt"))
+			if exists := err == nil; exists != tt.modelCard {
+				t.Errorf("MODEL_CARD.txt exists: %v, want %v", exists, tt.modelCard)
+			}
+			embedGo := readFile(t, filepath.Join(pkgDir, "embed.go"))
+			if embedded := strings.Contains(embedGo, "MODEL_CARD.txt"); embedded != tt.modelCard {
+				t.Errorf("embed.go embeds MODEL_CARD.txt: %v, want %v\n%s", embedded, tt.modelCard, embedGo)
+			}
+			readme := readFile(t, filepath.Join(pkgDir, "README.md"))
+			if !strings.Contains(readme, "license: See "+tt.license) {
+				t.Errorf("README.md doesn't point to %s for the voice's license:\n%s", tt.license, readme)
+			}
+			doc := readFile(t, filepath.Join(pkgDir, "doc.go"))
+			if !strings.Contains(doc, "License: see "+tt.docLicense+"\n") {
+				t.Errorf("doc.go doesn't point to %s for the voice's license:\n%s", tt.docLicense, doc)
+			}
+
+			names, err := ExtractArchive(context.Background(), pkgDir, t.TempDir(), false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{"voice.json", "voice.onnx"}
+			if tt.modelCard {
+				want = append(want, "MODEL_CARD")
+			}
+			slices.Sort(names)
+			slices.Sort(want)
+			if !slices.Equal(names, want) {
+				t.Errorf("archive has %q, want %q", names, want)
+			}
+		})
+	}
+}
+
+// testEntry is an entry of a test archive.
+type testEntry struct {
+	Name string
+	Body string
+	Mode int64
+	// Link, if set, makes the entry a symlink to Link.
+	Link string
+}
+
+// testTarGz returns a .tar.gz archive of entries.
+func testTarGz(t *testing.T, entries []testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.Name, Mode: e.Mode, Size: int64(len(e.Body))}
+		if e.Link != "" {
+			h.Typeflag, h.Linkname, h.Size = tar.TypeSymlink, e.Link, 0
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.Body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testRelease is a fake piper release holding a binary, a library and a
+// symlink to it, and data outside of the paths packaged.
+var testRelease = []testEntry{
+	{Name: "piper/piper", Body: "#!/bin/sh\necho piper\n", Mode: 0o755},
+	{Name: "piper/libpiper.so.1", Body: "library", Mode: 0o644},
+	{Name: "piper/libpiper.so", Link: "libpiper.so.1", Mode: 0o777},
+	{Name: "piper/espeak-ng-data/phontab", Body: "phonemes", Mode: 0o644},
+	{Name: "README", Body: "not packaged", Mode: 0o644},
+}
+
+// readArchive returns the headers and contents of the entries of the
+// archive filename.
+func readArchive(t *testing.T, filename string) (map[string]*tar.Header, map[string]string) {
+	t.Helper()
+	format, err := archiveFormatOf(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarball, err := OpenTarball(filename, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tarball.Close()
+	headers, contents := map[string]*tar.Header{}, map[string]string{}
+	for {
+		h, r, err := tarball.Next()
+		if err == io.EOF {
+			return headers, contents
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers[h.Name], contents[h.Name] = h, string(data)
+	}
+}
+
+// checkMeta checks that the metadata of the package in pkgDir lists files
+// and hashes the embedded files names.
+func checkMeta(t *testing.T, pkgDir string, files map[string]string, names ...string) Meta {
+	t.Helper()
+	var meta Meta
+	if err := json.Unmarshal([]byte(readFile(t, filepath.Join(pkgDir, MetadataFilename))), &meta); err != nil {
+		t.Fatal(err)
+	}
+	wantFiles := map[string]Hash{}
+	for name, data := range files {
+		wantFiles[name] = Hash(xxh3.HashString128(data))
+	}
+	if !maps.Equal(meta.Files, wantFiles) {
+		t.Errorf("metadata lists files %v, want %v", meta.Files, wantFiles)
+	}
+	slices.Sort(names)
+	h := xxh3.New()
+	for _, name := range names {
+		h.WriteString(readFile(t, filepath.Join(pkgDir, name)))
+	}
+	if want := Hash(h.Sum128()); meta.Hash != want {
+		t.Errorf("metadata hash is %s, want %s", meta.Hash, want)
+	}
+	return meta
+}
+
+// packageFiles lists the files in pkgDir.
+func packageFiles(t *testing.T, pkgDir string) []string {
+	t.Helper()
+	var names []string
+	err := filepath.WalkDir(pkgDir, func(filename string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(pkgDir, filename)
+		names = append(names, filepath.ToSlash(rel))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestInstallVoice(t *testing.T) {
+	s := newFixtureServer(t, testVoiceFiles())
+	b := newTestBuilder(t, s)
+	voice := VoiceSpec{Name: "test", URLs: []string{
+		s.URL + "/voices/en_GB-test-low.onnx",
+		s.URL + "/voices/en_GB-test-low.onnx.json",
+		s.URL + "/voices/MODEL_CARD",
+	}}
+	pkg, err := b.InstallVoice(context.Background(), voice, "v1.2.3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Name != "piper-voice-test-low" || pkg.Path != "github.com/piper-tts-go/piper-voice-test-low" || pkg.Quality != "low" {
+		t.Errorf("got package %+v", pkg)
+	}
+	pkgDir := filepath.Join(b.Dir, "piper-voice-test-low")
+	want := []string{"LICENSE", "MODEL_CARD.txt", "README.md", "dist.json", "dist.tzst", "doc.go", "embed.go", "go.mod"}
+	if got := packageFiles(t, pkgDir); !slices.Equal(got, want) {
+		t.Errorf("package has files %q, want %q", got, want)
+	}
+
+	files := map[string]string{
+		"voice.onnx": string(testONNX()),
+		"voice.json": testVoiceJSON,
+		"MODEL_CARD": testModelCard,
+	}
+	_, contents := readArchive(t, filepath.Join(pkgDir, "dist.tzst"))
+	if !maps.Equal(contents, files) {
+		t.Errorf("archive has entries %q", slices.Sorted(maps.Keys(contents)))
+	}
+	meta := checkMeta(t, pkgDir, files, "dist.tzst", "MODEL_CARD.txt")
+	if meta.Version != "v1.2.3" || meta.Language != "en_GB" || meta.Compression != "zstd" || !slices.Equal(meta.Sources, voice.URLs) {
+		t.Errorf("got metadata %+v", meta)
+	}
+	if meta.Voice == nil || meta.Voice.SampleRate != 22050 || meta.Voice.Quality != "low" {
+		t.Errorf("got voice info %+v", meta.Voice)
+	}
+	if meta.Hash != pkg.ContentHash {
+		t.Errorf("package hash is %s, metadata hash %s", pkg.ContentHash, meta.Hash)
+	}
+
+	wantEmbedGo := `// GENERATED FILE
+
+package test
+
+import (
+	"embed"
+	"github.com/piper-tts-go/piper-go-asset"
+)
+
+var (
+	//go:embed dist.tzst dist.json MODEL_CARD.txt
+	fs embed.FS
+
+	Asset = asset.Asset{Name: "test", FS: fs}
+)
+`
+	if got := readFile(t, filepath.Join(pkgDir, "embed.go")); got != wantEmbedGo {
+		t.Errorf("embed.go is\n%s\nwant\n%s", got, wantEmbedGo)
+	}
+	if got := readFile(t, filepath.Join(pkgDir, "go.mod")); !strings.Contains(got, "module github.com/piper-tts-go/piper-voice-test-low\n") {
+		t.Errorf("go.mod is\n%s", got)
+	}
+}
+
+func TestInstallPiper(t *testing.T) {
+	s := newFixtureServer(t, map[string][]byte{"/releases/piper_linux_x86_64.tar.gz": testTarGz(t, testRelease)})
+	b := newTestBuilder(t, s)
+	release := PiperRelease{
+		URL:         s.URL + "/releases/piper_linux_x86_64.tar.gz",
+		Paths:       []string{"piper/piper", "piper/libpiper.so", "piper/libpiper.so.1"},
+		StripPrefix: "piper/",
+		OS:          "linux",
+		Arch:        "amd64",
+	}
+	pkg, err := b.InstallPiper(context.Background(), "linux_amd64", "v1.2.3", release)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgDir := filepath.Join(b.Dir, "piper-bin-linux_amd64")
+	if pkg.Path != "github.com/piper-tts-go/piper-bin-linux_amd64" {
+		t.Errorf("got package path %s", pkg.Path)
+	}
+	want := []string{"LICENSE", "README.md", "dist.json", "dist.tzst", "embed.go", "go.mod"}
+	if got := packageFiles(t, pkgDir); !slices.Equal(got, want) {
+		t.Errorf("package has files %q, want %q", got, want)
+	}
+
+	headers, contents := readArchive(t, filepath.Join(pkgDir, "dist.tzst"))
+	wantContents := map[string]string{
+		"piper":         "#!/bin/sh\necho piper\n",
+		"libpiper.so.1": "library",
+		"libpiper.so":   "",
+	}
+	if !maps.Equal(contents, wantContents) {
+		t.Errorf("archive has entries %q", contents)
+	}
+	if h := headers["piper"]; h == nil || h.Mode != 0o755 {
+		t.Errorf("piper binary has header %+v", h)
+	}
+	if h := headers["libpiper.so"]; h == nil || h.Typeflag != tar.TypeSymlink || h.Linkname != "libpiper.so.1" {
+		t.Errorf("library symlink has header %+v", h)
+	}
+
+	// symlinks aren't hashed as files
+	meta := checkMeta(t, pkgDir, map[string]string{"piper": wantContents["piper"], "libpiper.so.1": "library"}, "dist.tzst")
+	if meta.SourceFormat != "tar.gz" || !slices.Equal(meta.Sources, []string{release.URL}) {
+		t.Errorf("got metadata %+v", meta)
+	}
+	if embedGo := readFile(t, filepath.Join(pkgDir, "embed.go")); !strings.Contains(embedGo, "Asset = asset.Asset{Name: \"linux_amd64\", FS: fs}\n") {
+		t.Errorf("embed.go is\n%s", embedGo)
+	}
+}
+
+func TestInstallVoiceHashIndependentOfDir(t *testing.T) {
+	s := newFixtureServer(t, testVoiceFiles())
+	voice := VoiceSpec{Name: "test", URLs: []string{
+		s.URL + "/voices/en_GB-test-low.onnx",
+		s.URL + "/voices/en_GB-test-low.onnx.json",
+		s.URL + "/voices/MODEL_CARD",
+	}}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relDir, err := filepath.Rel(wd, filepath.Join(t.TempDir(), "nested", "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashes []Hash
+	for _, dir := range []string{t.TempDir(), relDir} {
+		b := newTestBuilder(t, s)
+		b.Dir = dir
+		pkg, err := b.InstallVoice(context.Background(), voice, "v1.0.0", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, pkg.ContentHash)
+	}
+	if hashes[0] != hashes[1] {
+		t.Errorf("absolute and relative -dir give hashes %v and %v", hashes[0], hashes[1])
+	}
+}
+
+func TestInterruptedWriteKeepsFile(t *testing.T) {
+	src := writeFiles(t, map[string]string{"voice.json": testVoiceJSON, "MODEL_CARD": testModelCard})
+	config, err := readVoiceConfig(src["voice.json"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &PackageBuilder{Command: []string{"-voices=test"}}
+	tests := []struct {
+		name  string
+		write func(pkgDir string) error
+	}{
+		{MetadataFilename, func(pkgDir string) error {
+			_, err := InstallMeta(filepath.Join(pkgDir, MetadataFilename), Meta{Version: "v1.0.0"}, pkgDir)
+			return err
+		}},
+		{"MODEL_CARD.txt", func(pkgDir string) error {
+			return writeModelCard(filepath.Join(pkgDir, "MODEL_CARD.txt"), src["MODEL_CARD"])
+		}},
+		{"doc.go", func(pkgDir string) error {
+			return writeVoiceDoc(pkgDir, "test", "test", config, "MODEL_CARD.txt")
+		}},
+		{"config.go", func(pkgDir string) error {
+			return writeVoiceConfigGo(pkgDir, "test", src["voice.json"])
+		}},
+		{"generate.go", func(pkgDir string) error {
+			b.Dir = filepath.Dir(pkgDir)
+			return b.writeGenerate(pkgDir, "test", "test")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkgDir := t.TempDir()
+			filename := filepath.Join(pkgDir, tt.name)
+			const old = "previous contents\n"
+			if err := os.WriteFile(filename, []byte(old), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			// fail as if interrupted once the new contents are written
+			errInterrupted := errors.New("interrupted")
+			renameFile = func(oldpath, newpath string) error {
+				if got := readFile(t, oldpath); got == "" {
+					t.Errorf("interrupted before writing %s", tt.name)
+				}
+				return errInterrupted
+			}
+			defer func() { renameFile = os.Rename }()
+			if err := tt.write(pkgDir); !errors.Is(err, errInterrupted) {
+				t.Fatalf("got error %v, want %v", err, errInterrupted)
+			}
+			if got := readFile(t, filename); got != old {
+				t.Errorf("%s is %q after an interrupted write, want %q", tt.name, got, old)
+			}
+			entries, err := os.ReadDir(pkgDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Errorf("left %d files in the package directory, want 1", len(entries))
+			}
+
+			renameFile = os.Rename
+			if err := tt.write(pkgDir); err != nil {
+				t.Fatal(err)
+			}
+			if got := readFile(t, filename); got == old {
+				t.Errorf("%s wasn't replaced", tt.name)
+			}
+		})
+	}
+}
+
+func TestCompletedShared(t *testing.T) {
+	ctx := context.Background()
+	files, voices := testVoices(t)
+	s := newFixtureServer(t, files)
+	b := newTestBuilder(t, s)
+	shared, err := b.FindSharedFiles(ctx, voices(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadCheckpoint(filepath.Join(t.TempDir(), "checkpoint.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := b.CompletedShared(c, "v1.0.0", shared); ok {
+		t.Fatal("shared package completed before it was generated")
+	}
+	want, pkg, err := b.InstallShared(ctx, "v1.0.0", shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Record(*pkg); err != nil {
+		t.Fatal(err)
+	}
+	got, _, ok := b.CompletedShared(c, "v1.0.0", shared)
+	if !ok {
+		t.Fatal("recorded shared package not completed")
+	}
+	if got.Dir != want.Dir || got.Path != want.Path || !maps.Equal(got.Files, want.Files) {
+		t.Errorf("CompletedShared = %+v, want %+v", got, want)
+	}
+	if _, _, ok := b.CompletedShared(c, "v1.0.1", shared); ok {
+		t.Error("shared package completed at another version")
+	}
+	fewer := maps.Clone(shared)
+	for h := range fewer {
+		delete(fewer, h)
+		break
+	}
+	if _, _, ok := b.CompletedShared(c, "v1.0.0", fewer); ok {
+		t.Error("shared package completed with other files")
+	}
+}
@@ -0,0 +1,296 @@
+package piperpkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Rebuild regenerates embed.go, go.mod, README.md and LICENSE of the package
+// in pkgDir and builds it again, reusing its archive and metadata. The
+// package's assets and dependencies are read back from its embed.go and
+// go.mod, so only changes to b's options that don't affect the archive are
+// picked up.
+func (b *PackageBuilder) Rebuild(ctx context.Context, pkgDir string) (Meta, error) {
+	meta, ok := b.existingMeta(pkgDir)
+	if !ok {
+		return Meta{}, fmt.Errorf("no metadata %s in %q", b.metadataFilename(), pkgDir)
+	}
+	goMod, err := readGoMod(pkgDir)
+	if err != nil {
+		return Meta{}, err
+	}
+	embedGo, err := readEmbedGo(pkgDir)
+	if err != nil {
+		return Meta{}, err
+	}
+	if err := b.checkMajorVersion(meta.Version); err != nil {
+		return Meta{}, err
+	}
+	var deps []packageDep
+	for _, dep := range embedGo.imports {
+		dir, ok := goMod.replaces[dep.Path]
+		if !ok {
+			return Meta{}, fmt.Errorf("go.mod does not replace %s", dep.Path)
+		}
+		dep.Version = goMod.requires[dep.Path]
+		dep.Dir = filepath.Join(pkgDir, filepath.FromSlash(dir))
+		// generated dependencies are expected to be rebuilt at the same
+		// major version
+		dep.Path = trimMajorSuffix(dep.Path) + b.majorSuffix()
+		deps = append(deps, dep)
+	}
+	pkgPath := trimMajorSuffix(goMod.module) + b.majorSuffix()
+	embedPaths := slices.DeleteFunc(embedGo.embedPaths, func(name string) bool {
+		return name == b.archiveFilename() || name == b.metadataFilename()
+	})
+	if b.Mode != ModeLazy {
+		// left by a package previously generated in lazy mode
+		for _, name := range []string{"lazy.go", ".gitignore"} {
+			if err := os.Remove(filepath.Join(pkgDir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return Meta{}, fmt.Errorf("failed to remove %s: %w", name, err)
+			}
+		}
+	}
+	// binary packages are the only ones built from a release archive
+	voicePkg := meta.SourceFormat == ""
+	return b.generatePackage(ctx, voicePkg, pkgDir, embedGo.pkgName, pkgPath, embedGo.assets, deps, meta, embedPaths...)
+}
+
+type goModFile struct {
+	module string
+	// requires maps required modules to their version, and replaces
+	// replaced modules to their replacement.
+	requires map[string]string
+	replaces map[string]string
+}
+
+func readGoMod(pkgDir string) (*goModFile, error) {
+	src, err := os.ReadFile(filepath.Join(pkgDir, "go.mod"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read go.mod: %w", err)
+	}
+	goMod := &goModFile{requires: map[string]string{}, replaces: map[string]string{}}
+	block := ""
+	for _, line := range strings.Split(string(src), "\n") {
+		line, _, _ = strings.Cut(line, "//")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		directive := block
+		switch {
+		case fields[0] == ")":
+			block = ""
+			continue
+		case block == "" && len(fields) == 2 && fields[1] == "(":
+			block = fields[0]
+			continue
+		case block == "":
+			directive, fields = fields[0], fields[1:]
+		}
+		switch {
+		case directive == "module" && len(fields) == 1:
+			goMod.module = fields[0]
+		case directive == "require" && len(fields) == 2:
+			goMod.requires[fields[0]] = fields[1]
+		case directive == "replace" && len(fields) >= 3 && fields[len(fields)-2] == "=>":
+			goMod.replaces[fields[0]] = fields[len(fields)-1]
+		}
+	}
+	if goMod.module == "" {
+		return nil, errors.New("go.mod has no module directive")
+	}
+	return goMod, nil
+}
+
+type embedGoFile struct {
+	pkgName    string
+	embedPaths []string
+	assets     []packageAsset
+	// imports are the other generated packages imported, without their
+	// version and directory.
+	imports []packageDep
+}
+
+func readEmbedGo(pkgDir string) (*embedGoFile, error) {
+	filename := filepath.Join(pkgDir, "embed.go")
+	file, err := parser.ParseFile(token.NewFileSet(), filename, nil, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse embed.go: %w", err)
+	}
+	embedGo := &embedGoFile{pkgName: file.Name.Name}
+	for _, spec := range file.Imports {
+		if spec.Name == nil {
+			// embed, the asset module and what ModelCard needs
+			continue
+		}
+		importPath, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid import %s: %w", spec.Path.Value, err)
+		}
+		embedGo.imports = append(embedGo.imports, packageDep{Ident: spec.Name.Name, Path: importPath})
+	}
+	for _, group := range file.Comments {
+		for _, comment := range group.List {
+			if paths, ok := strings.CutPrefix(comment.Text, "//go:embed "); ok {
+				embedGo.embedPaths = append(embedGo.embedPaths, strings.Fields(paths)...)
+			}
+		}
+	}
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.VAR {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			value := spec.(*ast.ValueSpec)
+			if len(value.Names) != 1 || len(value.Values) != 1 {
+				continue
+			}
+			lit, ok := value.Values[0].(*ast.CompositeLit)
+			if !ok {
+				continue
+			}
+			a, err := readAsset(lit)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", value.Names[0].Name, err)
+			}
+			a.Var = value.Names[0].Name
+			embedGo.assets = append(embedGo.assets, a)
+		}
+	}
+	if len(embedGo.assets) == 0 {
+		return nil, errors.New("embed.go declares no asset")
+	}
+	return embedGo, nil
+}
+
+func readAsset(lit *ast.CompositeLit) (packageAsset, error) {
+	var a packageAsset
+	for _, elt := range lit.Elts {
+		kv, ok := elt.(*ast.KeyValueExpr)
+		if !ok {
+			return packageAsset{}, errors.New("unkeyed field")
+		}
+		key, _ := kv.Key.(*ast.Ident)
+		if key == nil {
+			continue
+		}
+		switch key.Name {
+		case "Name":
+			value, err := stringLit(key.Name, kv.Value)
+			if err != nil {
+				return packageAsset{}, err
+			}
+			a.Name = value
+		case "FS":
+			if err := readAssetFS(kv.Value, &a); err != nil {
+				return packageAsset{}, err
+			}
+		}
+	}
+	return a, nil
+}
+
+func readAssetFS(expr ast.Expr, a *packageAsset) error {
+	unary, ok := expr.(*ast.UnaryExpr)
+	if !ok || unary.Op != token.AND {
+		return nil
+	}
+	lit, ok := unary.X.(*ast.CompositeLit)
+	if !ok {
+		return nil
+	}
+	if typ, _ := lit.Type.(*ast.Ident); typ == nil || typ.Name != "assetFS" {
+		return nil
+	}
+	for _, elt := range lit.Elts {
+		kv, ok := elt.(*ast.KeyValueExpr)
+		if !ok {
+			return errors.New("unkeyed assetFS field")
+		}
+		key, _ := kv.Key.(*ast.Ident)
+		if key == nil {
+			continue
+		}
+		switch key.Name {
+		case "dir":
+			value, err := stringLit(key.Name, kv.Value)
+			if err != nil {
+				return err
+			}
+			a.Dir = value
+		case "base":
+			// pkg.Asset.FS
+			fs, ok := kv.Value.(*ast.SelectorExpr)
+			if !ok {
+				return errors.New("base is not a package's Asset")
+			}
+			sel, ok := fs.X.(*ast.SelectorExpr)
+			if !ok {
+				return errors.New("base is not a package's Asset")
+			}
+			pkg, ok := sel.X.(*ast.Ident)
+			if !ok {
+				return errors.New("base is not a package's Asset")
+			}
+			a.Base = pkg.Name + "." + sel.Sel.Name
+		}
+	}
+	return nil
+}
+
+func embeddedArchive(pkgDir string) (string, error) {
+	file, err := parser.ParseFile(token.NewFileSet(), filepath.Join(pkgDir, "embed.go"), nil, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse embed.go: %w", err)
+	}
+	var (
+		archive string
+		litErr  error
+	)
+	ast.Inspect(file, func(n ast.Node) bool {
+		if archive != "" || litErr != nil {
+			return false
+		}
+		lit, ok := n.(*ast.CompositeLit)
+		if !ok {
+			return true
+		}
+		if typ, _ := lit.Type.(*ast.Ident); typ == nil || typ.Name != "assetFS" {
+			return true
+		}
+		for _, elt := range lit.Elts {
+			kv, ok := elt.(*ast.KeyValueExpr)
+			if !ok {
+				continue
+			}
+			if key, _ := kv.Key.(*ast.Ident); key != nil && key.Name == "archive" {
+				archive, litErr = stringLit(key.Name, kv.Value)
+			}
+		}
+		return false
+	})
+	return archive, litErr
+}
+
+func stringLit(name string, expr ast.Expr) (string, error) {
+	s, ok := expr.(*ast.BasicLit)
+	if !ok || s.Kind != token.STRING {
+		return "", fmt.Errorf("%s is not a string", name)
+	}
+	value, err := strconv.Unquote(s.Value)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return value, nil
+}
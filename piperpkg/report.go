@@ -0,0 +1,120 @@
+package piperpkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"slices"
+)
+
+// Package describes a successfully generated package.
+type Package struct {
+	Name    string
+	Path    string
+	Version string
+	// ContentHash is the Meta.Hash of the package, covering its archive and
+	// the other files it embeds, such as the model card, but not the
+	// metadata.
+	ContentHash Hash
+	// Size is the size in bytes of the archive.
+	Size    int64
+	Sources []string
+	// Kind is one of the Kind constants.
+	Kind string `json:",omitempty"`
+	// Language and Quality describe the voice of a voice package.
+	Language string `json:",omitempty"`
+	Quality  string `json:",omitempty"`
+}
+
+// Kinds of generated packages.
+const (
+	KindVoice  = "voice"
+	KindBundle = "bundle"
+	KindShared = "shared"
+	KindBinary = "binary"
+)
+
+// Failure describes a package that could not be generated.
+type Failure struct {
+	Name  string
+	Error string
+}
+
+// Report summarizes a generation run for consumption by other tools.
+type Report struct {
+	Packages []Package
+	Failures []Failure
+	// Skipped lists packages left alone because they're already at the
+	// target version or were completed by an interrupted run.
+	Skipped []string `json:",omitempty"`
+}
+
+func newPackage(kind, name, path, archiveFilename string, meta Meta) (*Package, error) {
+	info, err := os.Stat(archiveFilename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive info: %w", err)
+	}
+	return &Package{
+		Name:        name,
+		Path:        path,
+		Version:     meta.Version,
+		ContentHash: meta.Hash,
+		Size:        info.Size(),
+		Sources:     meta.Sources,
+		Kind:        kind,
+		Language:    meta.Language,
+	}, nil
+}
+
+// Manifest lists every package generated into a directory.
+type Manifest struct {
+	Packages []Package
+}
+
+// UpdateManifest adds packages to the manifest in filename, replacing any
+// entries of the same name, and creates the manifest if it doesn't exist.
+func UpdateManifest(filename string, packages []Package) error {
+	var manifest Manifest
+	src, err := os.ReadFile(filename)
+	if err == nil {
+		if err := json.Unmarshal(src, &manifest); err != nil {
+			return fmt.Errorf("failed to parse manifest %q: %w", filename, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	byName := map[string]Package{}
+	for _, pkg := range manifest.Packages {
+		byName[pkg.Name] = pkg
+	}
+	for _, pkg := range packages {
+		byName[pkg.Name] = pkg
+	}
+	manifest.Packages = manifest.Packages[:0]
+	for _, name := range slices.Sorted(maps.Keys(byName)) {
+		manifest.Packages = append(manifest.Packages, byName[name])
+	}
+	src, err = json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	src = append(src, '\n')
+	if err := writeFileAtomic(filename, src, 0o644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+func WriteReport(filename string, report Report) error {
+	src, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %w", err)
+	}
+	if err := writeFileAtomic(filename, src, 0o644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
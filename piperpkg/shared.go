@@ -0,0 +1,139 @@
+package piperpkg
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/zeebo/xxh3"
+)
+
+// SharedPackage is a package holding the files identical across several
+// voices, which the voice packages depend on instead of embedding copies.
+type SharedPackage struct {
+	Name    string
+	Path    string
+	Version string
+	Dir     string
+	// Files maps the hash of each shared file to its downloaded filename.
+	Files map[Hash]string
+}
+
+func fileHash(filename string) (Hash, error) {
+	h := xxh3.New()
+	if err := hashFile(h, filename); err != nil {
+		return Hash{}, fmt.Errorf("failed to hash file %q: %w", filename, err)
+	}
+	return Hash(h.Sum128()), nil
+}
+
+func (b *PackageBuilder) sharedFileHash(shared map[Hash]string, url string) (*Hash, error) {
+	if len(shared) == 0 {
+		return nil, nil
+	}
+	h, err := b.Downloader.Hash(url)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := shared[h]; !ok {
+		return nil, nil
+	}
+	return &h, nil
+}
+
+// FindSharedFiles downloads the files of voices and returns those that are
+// byte-identical across more than one voice, keyed by hash.
+func (b *PackageBuilder) FindSharedFiles(ctx context.Context, voices []VoiceSpec) (map[Hash]string, error) {
+	filenames := map[Hash]string{}
+	counts := map[Hash]int{}
+	for _, voice := range voices {
+		seen := map[Hash]bool{}
+		for _, url := range voice.URLs {
+			filename, err := b.Downloader.Download(ctx, url)
+			if err != nil {
+				return nil, fmt.Errorf("failed to download voice %q: %w", voice.Name, err)
+			}
+			h, err := b.Downloader.Hash(url)
+			if err != nil {
+				return nil, err
+			}
+			if seen[h] {
+				continue
+			}
+			seen[h] = true
+			filenames[h] = filename
+			counts[h]++
+		}
+	}
+	maps.DeleteFunc(filenames, func(h Hash, _ string) bool { return counts[h] < 2 })
+	return filenames, nil
+}
+
+func (b *PackageBuilder) sharedPackage(version string, files map[Hash]string) (*SharedPackage, error) {
+	pkgDir, err := b.PackageDir(SharedLocation)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.checkMajorVersion(version); err != nil {
+		return nil, err
+	}
+	return &SharedPackage{
+		Name:    SharedLocation.Package,
+		Path:    b.modulePath(SharedLocation.Package),
+		Version: "v" + strings.TrimPrefix(version, "v"),
+		Dir:     pkgDir,
+		Files:   files,
+	}, nil
+}
+
+// InstallShared generates the package holding files shared across voices,
+// each stored in the tarball under its hash.
+func (b *PackageBuilder) InstallShared(ctx context.Context, version string, files map[Hash]string) (_ *SharedPackage, _ *Package, retErr error) {
+	shared, err := b.sharedPackage(version, files)
+	if err != nil {
+		return nil, nil, err
+	}
+	packageDirectory, commit, err := b.stagePackage(shared.Dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { retErr = commit(retErr) }()
+	archiveFilename := filepath.Join(packageDirectory, b.archiveFilename())
+	tarball, err := b.newTarball(archiveFilename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create tarball: %w", err)
+	}
+	hashes := slices.SortedFunc(maps.Keys(files), func(a, b Hash) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	for _, h := range hashes {
+		if err := tarball.AppendFile(h.String(), files[h]); err != nil {
+			return nil, nil, closeTarball(tarball, fmt.Errorf("failed to add %q to tarball: %w", files[h], err))
+		}
+	}
+	if err := closeTarball(tarball, nil); err != nil {
+		return nil, nil, err
+	}
+	assets := []packageAsset{{Var: "Asset", Name: "shared"}}
+	// the shared files depend on every voice, so regenerate them all
+	if err := b.writeGenerate(packageDirectory, packageIdentifier(shared.Name)); err != nil {
+		return nil, nil, fmt.Errorf("failed to write generate.go: %w", err)
+	}
+	meta, err := b.generatePackage(ctx, true, packageDirectory, packageIdentifier(shared.Name), shared.Path, assets, nil, Meta{
+		Version: version,
+		Files:   tarball.Hashes(),
+
+		UncompressedSize: tarball.UncompressedSize(),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate package: %w", err)
+	}
+	pkg, err := newPackage(KindShared, shared.Name, shared.Path, archiveFilename, meta)
+	if err != nil {
+		return nil, nil, err
+	}
+	return shared, pkg, nil
+}
@@ -0,0 +1,576 @@
+package piperpkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/zeebo/xxh3"
+)
+
+// ArchiveFormat is a compression applied to the tar archives embedded in
+// generated packages.
+type ArchiveFormat struct {
+	// Compression names the compression in Meta.
+	Compression string
+	// Extension is the file extension of archives in this format.
+	Extension string
+	// NewEncoder returns a writer compressing into w.
+	NewEncoder func(w io.Writer) (io.WriteCloser, error)
+	// NewFallbackEncoder, if set, returns a writer compressing into w with
+	// the library's default options, for when NewEncoder fails.
+	NewFallbackEncoder func(w io.Writer) (io.WriteCloser, error)
+	// NewDecoder returns a reader decompressing r.
+	NewDecoder func(r io.Reader) (io.ReadCloser, error)
+}
+
+// ArchiveFormats are the supported archive formats by name.
+var ArchiveFormats = map[string]ArchiveFormat{
+	"tzst": {
+		Compression: "zstd",
+		Extension:   ".tzst",
+		NewEncoder: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+		},
+		NewFallbackEncoder: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		},
+		NewDecoder: func(r io.Reader) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+	},
+	"tgz": {
+		Compression: "gzip",
+		Extension:   ".tgz",
+		NewEncoder: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, gzip.BestCompression)
+		},
+		NewFallbackEncoder: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		NewDecoder: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+}
+
+func archiveFormatOf(filename string) (ArchiveFormat, error) {
+	for _, format := range ArchiveFormats {
+		if strings.HasSuffix(filename, format.Extension) {
+			return format, nil
+		}
+	}
+	return ArchiveFormat{}, fmt.Errorf("unknown archive format of %q", filename)
+}
+
+func compressionFormat(compression string) (ArchiveFormat, error) {
+	if compression == "" {
+		compression = "zstd"
+	}
+	for _, format := range ArchiveFormats {
+		if format.Compression == compression {
+			return format, nil
+		}
+	}
+	return ArchiveFormat{}, fmt.Errorf("unknown compression %q", compression)
+}
+
+func checkEntryName(names map[string]string, name string) error {
+	folded := strings.ToLower(path.Clean(name))
+	if prev, ok := names[folded]; ok {
+		if prev == name {
+			return fmt.Errorf("duplicate entry %q", name)
+		}
+		return fmt.Errorf("entry %q collides with %q on case-insensitive filesystems", name, prev)
+	}
+	names[folded] = name
+	return nil
+}
+
+var errEncoder = errors.New("failed to create encoder")
+
+// TarFormats are the supported tar header formats by name.
+var TarFormats = map[string]tar.Format{
+	"gnu":   tar.FormatGNU,
+	"pax":   tar.FormatPAX,
+	"ustar": tar.FormatUSTAR,
+}
+
+// TarPerms forces the permissions of tarball entries. Zero modes keep the
+// permissions of the source files.
+type TarPerms struct {
+	// File is the mode of regular files.
+	File os.FileMode
+	// Exec is the mode of regular files with any executable bit set.
+	Exec os.FileMode
+}
+
+func (p TarPerms) apply(h *tar.Header) {
+	if !h.FileInfo().Mode().IsRegular() {
+		return
+	}
+	if h.Mode&0o111 != 0 {
+		if p.Exec != 0 {
+			h.Mode = int64(p.Exec.Perm())
+		}
+	} else if p.File != 0 {
+		h.Mode = int64(p.File.Perm())
+	}
+}
+
+type Tarball struct {
+	// file is closed along with the tarball if set.
+	file    io.Closer
+	encoder io.WriteCloser
+	writer  *tar.Writer
+	// frames, if set, is the encoder of a tarball compressing every entry in
+	// its own frame.
+	frames *frameWriter
+	// members locates the frame of each regular file of a framed tarball.
+	members map[string]ArchiveMember
+	// prev, if set, is a framed archive whose frames prevMembers locates.
+	// Those of files unchanged in this tarball are copied rather than
+	// compressed again.
+	prev        *os.File
+	prevMembers map[string]ArchiveMember
+	reused      int
+	perms       TarPerms
+	// headerFormat, if known, is the format of every header.
+	headerFormat tar.Format
+	// manifest writes a ManifestFilename entry on Close.
+	manifest bool
+	// names maps the folded name of each entry to the entry's name.
+	names  map[string]string
+	hashes map[string]Hash
+	sizes  map[string]int64
+	// size is the total size of the entries' data.
+	size int64
+}
+
+// ManifestFilename is the last entry of archives written with a manifest,
+// mapping the name of every regular file before it to its ManifestEntry.
+const ManifestFilename = "MANIFEST.json"
+
+// ManifestEntry describes a file in an archive's manifest.
+type ManifestEntry struct {
+	Size int64
+	Hash Hash
+}
+
+func NewTarball(filename string, format ArchiveFormat, perms TarPerms) (*Tarball, error) {
+	return newTarballFile(filename, format, perms, false)
+}
+
+func newTarballFile(filename string, format ArchiveFormat, perms TarPerms, framed bool) (*Tarball, error) {
+	os.MkdirAll(filepath.Dir(filename), 0755)
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file %q: %w", filename, err)
+	}
+
+	tarball, err := newTarballWriter(file, format, perms, framed)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	tarball.file = file
+	return tarball, nil
+}
+
+// NewTarballWriter returns a Tarball writing the archive to w, which is left
+// open by Close.
+func NewTarballWriter(w io.Writer, format ArchiveFormat, perms TarPerms) (*Tarball, error) {
+	return newTarballWriter(w, format, perms, false)
+}
+
+func newTarballWriter(w io.Writer, format ArchiveFormat, perms TarPerms, framed bool) (*Tarball, error) {
+	tarball := &Tarball{
+		perms:  perms,
+		names:  map[string]string{},
+		hashes: map[string]Hash{},
+		sizes:  map[string]int64{},
+	}
+	var (
+		encoder io.WriteCloser
+		err     error
+	)
+	if framed {
+		// the frames are encoded as entries are written, so only check that
+		// an encoder can be created
+		if encoder, err = format.NewEncoder(io.Discard); err == nil {
+			err = encoder.Close()
+		}
+		tarball.frames = &frameWriter{w: w, format: format}
+		tarball.members = map[string]ArchiveMember{}
+		encoder = tarball.frames
+	} else {
+		encoder, err = format.NewEncoder(w)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w for %s: %w", errEncoder, format.Compression, err)
+	}
+	tarball.encoder = encoder
+	tarball.writer = tar.NewWriter(encoder)
+	return tarball, nil
+}
+
+// ArchiveMember locates the compression frame holding an entry of an archive
+// written by a framed Tarball: its header, data and padding.
+type ArchiveMember struct {
+	Offset int64
+	Size   int64
+}
+
+type frameWriter struct {
+	w      io.Writer
+	format ArchiveFormat
+	// encoder compresses the current frame, if one was started.
+	encoder io.WriteCloser
+	// offset is the number of bytes written to w.
+	offset int64
+}
+
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	if fw.encoder == nil {
+		encoder, err := fw.format.NewEncoder(writerFunc(fw.writeRaw))
+		if err != nil {
+			return 0, fmt.Errorf("%w for %s: %w", errEncoder, fw.format.Compression, err)
+		}
+		fw.encoder = encoder
+	}
+	return fw.encoder.Write(p)
+}
+
+func (fw *frameWriter) writeRaw(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.offset += int64(n)
+	return n, err
+}
+
+func (fw *frameWriter) endFrame() error {
+	if fw.encoder == nil {
+		return nil
+	}
+	err := fw.encoder.Close()
+	fw.encoder = nil
+	return err
+}
+
+func (fw *frameWriter) Close() error {
+	return fw.endFrame()
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func (tb *Tarball) reusePrevious(filename string, members map[string]ArchiveMember) error {
+	if tb.frames == nil {
+		return errors.New("only framed tarballs can reuse frames")
+	}
+	prev, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open previous archive: %w", err)
+	}
+	tb.prev = prev
+	tb.prevMembers = members
+	return nil
+}
+
+func (tb *Tarball) appendPrevious(h *tar.Header, r io.ReadSeeker) (bool, error) {
+	member, ok := tb.prevMembers[h.Name]
+	if !ok {
+		return false, nil
+	}
+	hasher := xxh3.New()
+	size, err := io.Copy(hasher, r)
+	if err != nil {
+		return false, fmt.Errorf("failed to copy data: %w", err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return false, fmt.Errorf("failed to rewind data: %w", err)
+	}
+	hash := Hash(hasher.Sum128())
+	if size != h.Size || !tb.frameHolds(member, h, hash) {
+		return false, nil
+	}
+	start := tb.frames.offset
+	if _, err := io.Copy(writerFunc(tb.frames.writeRaw), io.NewSectionReader(tb.prev, member.Offset, member.Size)); err != nil {
+		return false, fmt.Errorf("failed to copy previous frame: %w", err)
+	}
+	tb.members[h.Name] = ArchiveMember{Offset: start, Size: tb.frames.offset - start}
+	tb.hashes[h.Name] = hash
+	tb.sizes[h.Name] = h.Size
+	tb.size += h.Size
+	tb.reused++
+	return true, nil
+}
+
+func (tb *Tarball) frameHolds(member ArchiveMember, h *tar.Header, hash Hash) bool {
+	var header bytes.Buffer
+	if err := tar.NewWriter(&header).WriteHeader(h); err != nil {
+		return false
+	}
+	decoder, err := tb.frames.format.NewDecoder(io.NewSectionReader(tb.prev, member.Offset, member.Size))
+	if err != nil {
+		return false
+	}
+	defer decoder.Close()
+	prevHeader := make([]byte, header.Len())
+	if _, err := io.ReadFull(decoder, prevHeader); err != nil || !bytes.Equal(prevHeader, header.Bytes()) {
+		return false
+	}
+	hasher := xxh3.New()
+	if n, err := io.CopyN(hasher, decoder, h.Size); err != nil || n != h.Size || Hash(hasher.Sum128()) != hash {
+		return false
+	}
+	padding, err := io.ReadAll(decoder)
+	return err == nil && len(padding) == int(-h.Size&511) && !slices.ContainsFunc(padding, func(b byte) bool { return b != 0 })
+}
+
+// Members returns where the frame of each regular file appended so far is,
+// or nil if tb isn't framed.
+func (tb *Tarball) Members() map[string]ArchiveMember {
+	return maps.Clone(tb.members)
+}
+
+func (tb *Tarball) Append(h *tar.Header, r io.Reader) error {
+	if err := checkEntryName(tb.names, h.Name); err != nil {
+		return err
+	}
+	tb.perms.apply(h)
+	if tb.headerFormat != tar.FormatUnknown {
+		h.Format = tb.headerFormat
+	}
+	if h.Format == tar.FormatUSTAR {
+		if err := checkUSTARNames(h); err != nil {
+			return err
+		}
+	}
+	// never leak the build host's users into the archive
+	h.Uid, h.Gid, h.Uname, h.Gname = 0, 0, "", ""
+	if rs, ok := r.(io.ReadSeeker); ok && tb.prev != nil && h.FileInfo().Mode().IsRegular() {
+		if reused, err := tb.appendPrevious(h, rs); reused || err != nil {
+			return err
+		}
+	}
+	var start int64
+	if tb.frames != nil {
+		start = tb.frames.offset
+	}
+	if err := tb.writer.WriteHeader(h); err != nil {
+		if tb.headerFormat != tar.FormatUnknown {
+			return fmt.Errorf("failed to write header in %s format: %w", tb.headerFormat, err)
+		}
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+	hasher := xxh3.New()
+	if _, err := io.Copy(io.MultiWriter(tb.writer, hasher), r); err != nil {
+		return fmt.Errorf("failed to copy data: %w", err)
+	}
+	if err := tb.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush data: %w", err)
+	}
+	if tb.frames != nil {
+		if err := tb.frames.endFrame(); err != nil {
+			return fmt.Errorf("failed to end frame: %w", err)
+		}
+		if h.FileInfo().Mode().IsRegular() {
+			tb.members[h.Name] = ArchiveMember{Offset: start, Size: tb.frames.offset - start}
+		}
+	}
+	tb.size += h.Size
+	if h.FileInfo().Mode().IsRegular() {
+		tb.hashes[h.Name] = Hash(hasher.Sum128())
+		tb.sizes[h.Name] = h.Size
+	}
+	return nil
+}
+
+func checkUSTARNames(h *tar.Header) error {
+	fits := len(h.Name) <= 100
+	for i := 0; !fits && i < len(h.Name) && i <= 155; i++ {
+		fits = h.Name[i] == '/' && i > 0 && len(h.Name)-i-1 <= 100 && i+1 < len(h.Name)
+	}
+	if !fits {
+		return fmt.Errorf("entry name %q is %d bytes, too long for the ustar format; use the gnu or pax format", h.Name, len(h.Name))
+	}
+	if len(h.Linkname) > 100 {
+		return fmt.Errorf("link target %q of %q is %d bytes, more than the 100 of the ustar format; use the gnu or pax format", h.Linkname, h.Name, len(h.Linkname))
+	}
+	return nil
+}
+
+// Hashes returns the hash of each regular file appended so far.
+func (tb *Tarball) Hashes() map[string]Hash {
+	return maps.Clone(tb.hashes)
+}
+
+func closeTarball(tarball *Tarball, err error) error {
+	if closeErr := tarball.Close(); closeErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to close tarball: %w", closeErr))
+	}
+	return err
+}
+
+// UncompressedSize returns the total size of the data appended so far.
+func (tb *Tarball) UncompressedSize() int64 {
+	return tb.size
+}
+
+func (tb *Tarball) AppendFile(dest, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %w", src, err)
+	}
+	defer f.Close()
+
+	info, err := os.Lstat(src)
+	if err != nil {
+		return fmt.Errorf("failed to read file info: %w", err)
+	}
+	header := &tar.Header{
+		Name: dest,
+		Mode: int64(info.Mode().Perm()),
+		Size: info.Size(),
+	}
+	r := io.Reader(f)
+	if info.Mode()&os.ModeSymlink != 0 {
+		nm, err := os.Readlink(src)
+		if err != nil {
+			return fmt.Errorf("failed to read symlink: %w", err)
+		}
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = nm
+		header.Size = 0
+		r = bytes.NewReader(nil)
+	}
+	if err := tb.Append(header, r); err != nil {
+		return fmt.Errorf("failed to append file %q: %w", src, err)
+	}
+	return nil
+}
+
+func (tb *Tarball) appendManifest() error {
+	manifest := make(map[string]ManifestEntry, len(tb.hashes))
+	for name, h := range tb.hashes {
+		manifest[name] = ManifestEntry{Size: tb.sizes[name], Hash: h}
+	}
+	src, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	header := &tar.Header{
+		Name: ManifestFilename,
+		Mode: 0o644,
+		Size: int64(len(src)),
+	}
+	if err := tb.Append(header, bytes.NewReader(src)); err != nil {
+		return fmt.Errorf("failed to append manifest: %w", err)
+	}
+	return nil
+}
+
+func (tb *Tarball) Close() (err error) {
+	if tb.manifest {
+		tb.manifest = false
+		err = tb.appendManifest()
+	}
+	if closeErr := tb.writer.Close(); closeErr != nil {
+		err = errors.Join(err, fmt.Errorf("failed to close writer: %w", closeErr))
+	}
+	if closeErr := tb.encoder.Close(); closeErr != nil {
+		err = errors.Join(err, fmt.Errorf("failed to close encoder: %w", closeErr))
+	}
+	if tb.prev != nil {
+		if closeErr := tb.prev.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close previous archive: %w", closeErr))
+		}
+	}
+	if tb.file == nil {
+		return
+	}
+	if closeErr := tb.file.Close(); closeErr != nil {
+		err = errors.Join(err, fmt.Errorf("failed to close file: %w", closeErr))
+	}
+	return
+}
+
+// TarballReader reads back the entries of an archive written by a Tarball.
+type TarballReader struct {
+	// file is closed along with the reader if set.
+	file    io.Closer
+	decoder io.ReadCloser
+	reader  *tar.Reader
+}
+
+// OpenTarball opens the archive filename in the given format.
+func OpenTarball(filename string, format ArchiveFormat) (*TarballReader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %q: %w", filename, err)
+	}
+	tarball, err := NewTarballReader(file, format)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	tarball.file = file
+	return tarball, nil
+}
+
+// NewTarballReader returns a TarballReader reading the archive from r, which
+// is left open by Close.
+func NewTarballReader(r io.Reader, format ArchiveFormat) (*TarballReader, error) {
+	decoder, err := format.NewDecoder(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s decoder: %w", format.Compression, err)
+	}
+	return &TarballReader{
+		decoder: decoder,
+		reader:  tar.NewReader(decoder),
+	}, nil
+}
+
+// Next returns the header of the next entry and a reader of its data, valid
+// until the following call. It returns io.EOF after the last entry.
+func (tr *TarballReader) Next() (*tar.Header, io.Reader, error) {
+	h, err := tr.reader.Next()
+	if err == io.EOF {
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	return h, tr.reader, nil
+}
+
+func (tr *TarballReader) Close() (err error) {
+	if closeErr := tr.decoder.Close(); closeErr != nil {
+		err = errors.Join(err, fmt.Errorf("failed to close decoder: %w", closeErr))
+	}
+	if tr.file == nil {
+		return
+	}
+	if closeErr := tr.file.Close(); closeErr != nil {
+		err = errors.Join(err, fmt.Errorf("failed to close file: %w", closeErr))
+	}
+	return
+}
@@ -0,0 +1,379 @@
+package piperpkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files into a temporary directory, returning their
+// filenames by name.
+func writeFiles(t *testing.T, files map[string]string) map[string]string {
+	t.Helper()
+	dir := t.TempDir()
+	filenames := map[string]string{}
+	for name, data := range files {
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		filenames[name] = filename
+	}
+	return filenames
+}
+
+// writeFramedTarball writes files, in order of names, to a framed tarball at
+// filename, reusing the frames of prev if set.
+func writeFramedTarball(t *testing.T, filename string, names []string, files map[string]string, prev string, prevMembers map[string]ArchiveMember) *Tarball {
+	t.Helper()
+	tarball, err := newTarballFile(filename, ArchiveFormats["tzst"], TarPerms{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev != "" {
+		if err := tarball.reusePrevious(prev, prevMembers); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filenames := writeFiles(t, files)
+	for _, name := range names {
+		if err := tarball.AppendFile(name, filenames[name]); err != nil {
+			t.Fatal(closeTarball(tarball, err))
+		}
+	}
+	if err := tarball.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return tarball
+}
+
+// frame returns the bytes of member in the archive filename.
+func frame(t *testing.T, filename string, member ArchiveMember) []byte {
+	t.Helper()
+	data := []byte(readFile(t, filename))
+	if member.Offset < 0 || member.Offset+member.Size > int64(len(data)) {
+		t.Fatalf("member %+v is outside of %d byte archive", member, len(data))
+	}
+	return data[member.Offset : member.Offset+member.Size]
+}
+
+func TestFramedTarballReuse(t *testing.T) {
+	names := []string{"voice.onnx", "voice.json", "MODEL_CARD"}
+	old := map[string]string{
+		"voice.onnx": string(bytes.Repeat([]byte("model"), 10000)),
+		"voice.json": `{"audio": {"sample_rate": 22050}}`,
+		"MODEL_CARD": testModelCard,
+	}
+	changed := maps.Clone(old)
+	changed["voice.json"] = `{"audio": {"sample_rate": 16000}}`
+
+	tests := []struct {
+		name string
+		// corrupt, if set, is the member of the previous archive to corrupt.
+		corrupt    string
+		wantReused int
+	}{
+		{name: "unchanged files", wantReused: 2},
+		{name: "corrupt frame", corrupt: "voice.onnx", wantReused: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			prevFilename := filepath.Join(dir, "prev.tzst")
+			prev := writeFramedTarball(t, prevFilename, names, old, "", nil)
+			_, contents := readArchive(t, prevFilename)
+			if !maps.Equal(contents, old) {
+				t.Fatalf("framed archive has entries %q", contents)
+			}
+			prevMembers := prev.Members()
+			if len(prevMembers) != len(names) {
+				t.Fatalf("framed archive has members %+v", prevMembers)
+			}
+			if tt.corrupt != "" {
+				data := []byte(readFile(t, prevFilename))
+				member := prevMembers[tt.corrupt]
+				data[member.Offset+member.Size/2] ^= 0xff
+				if err := os.WriteFile(prevFilename, data, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			filename := filepath.Join(dir, "dist.tzst")
+			tarball := writeFramedTarball(t, filename, names, changed, prevFilename, prevMembers)
+			if tarball.reused != tt.wantReused {
+				t.Errorf("reused %d frames, want %d", tarball.reused, tt.wantReused)
+			}
+			_, contents = readArchive(t, filename)
+			if !maps.Equal(contents, changed) {
+				t.Errorf("archive has entries %q", contents)
+			}
+			members := tarball.Members()
+			for _, name := range names {
+				reused := bytes.Equal(frame(t, filename, members[name]), frame(t, prevFilename, prevMembers[name]))
+				if want := changed[name] == old[name] && name != tt.corrupt; reused != want {
+					t.Errorf("frame of %s reused: %v, want %v", name, reused, want)
+				}
+			}
+			if !maps.Equal(tarball.Hashes(), writeFramedTarball(t, filepath.Join(dir, "fresh.tzst"), names, changed, "", nil).Hashes()) {
+				t.Error("hashes differ from a tarball written without reuse")
+			}
+		})
+	}
+}
+
+func TestFramedTarballDecodesAsOneStream(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "dist.tzst")
+	files := map[string]string{"a": "first", "b": "second"}
+	tarball := writeFramedTarball(t, filename, []string{"a", "b"}, files, "", nil)
+	members := tarball.Members()
+	// the frames are contiguous, followed by that of the end of the archive
+	if members["a"].Offset != 0 || members["b"].Offset != members["a"].Size {
+		t.Errorf("members %+v aren't contiguous", members)
+	}
+	reader, err := OpenTarball(filename, ArchiveFormats["tzst"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	got := map[string]string{}
+	for {
+		h, r, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[h.Name] = string(data)
+	}
+	if !maps.Equal(got, files) {
+		t.Errorf("read entries %q, want %q", got, files)
+	}
+	outDir := t.TempDir()
+	if _, err := ExtractArchive(context.Background(), filename, outDir, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if got := readFile(t, filepath.Join(outDir, name)); got != data {
+			t.Errorf("extracted %s is %q, want %q", name, got, data)
+		}
+	}
+}
+
+func TestAppendFileModes(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		mode os.FileMode
+	}{
+		{"piper", 0o755},
+		{"voice.json", 0o644},
+	}
+	filename := filepath.Join(dir, "dist.tzst")
+	tarball, err := NewTarball(filename, ArchiveFormats["tzst"], TarPerms{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		src := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(src, []byte(tt.name), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		// set after creating the file so the umask doesn't apply
+		if err := os.Chmod(src, tt.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := tarball.AppendFile(tt.name, src); err != nil {
+			t.Fatal(closeTarball(tarball, err))
+		}
+	}
+	if err := tarball.Close(); err != nil {
+		t.Fatal(err)
+	}
+	headers, _ := readArchive(t, filename)
+	for _, tt := range tests {
+		if h := headers[tt.name]; h == nil || h.Mode != int64(tt.mode) {
+			t.Errorf("%s has header %+v, want mode %#o", tt.name, h, tt.mode)
+		}
+	}
+}
+
+// trackingBuffer is a bytes.Buffer recording whether it was closed.
+type trackingBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *trackingBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestNewTarballWriter(t *testing.T) {
+	files := map[string]string{"voice.onnx": "model", "voice.json": "{}"}
+	for _, name := range []string{"tzst", "tgz"} {
+		t.Run(name, func(t *testing.T) {
+			format := ArchiveFormats[name]
+			var buf trackingBuffer
+			tarball, err := NewTarballWriter(&buf, format, TarPerms{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range []string{"voice.onnx", "voice.json"} {
+				h := &tar.Header{Name: entry, Mode: 0o644, Size: int64(len(files[entry]))}
+				if err := tarball.Append(h, strings.NewReader(files[entry])); err != nil {
+					t.Fatal(closeTarball(tarball, err))
+				}
+			}
+			if err := tarball.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if buf.closed {
+				t.Error("Close closed the writer")
+			}
+
+			reader, err := NewTarballReader(bytes.NewReader(buf.Bytes()), format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			var names []string
+			for {
+				h, r, err := reader.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != files[h.Name] {
+					t.Errorf("%s holds %q, want %q", h.Name, data, files[h.Name])
+				}
+				names = append(names, h.Name)
+			}
+			if want := []string{"voice.onnx", "voice.json"}; !slices.Equal(names, want) {
+				t.Errorf("archive has entries %q, want %q", names, want)
+			}
+		})
+	}
+}
+
+func TestCloseTarballJoinsErrors(t *testing.T) {
+	errAppend := errors.New("append failed")
+	tests := []struct {
+		name  string
+		err   error
+		limit int
+		// want are the errors that closeTarball must return.
+		want []error
+	}{
+		{"none", nil, 1 << 20, nil},
+		{"operation", errAppend, 1 << 20, []error{errAppend}},
+		{"close", nil, 0, []error{errWriteLimit}},
+		{"both", errAppend, 0, []error{errAppend, errWriteLimit}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tarball, err := NewTarballWriter(&limitedWriter{n: tt.limit}, ArchiveFormats["tzst"], TarPerms{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := &tar.Header{Name: "voice.onnx", Mode: 0o644, Size: 5}
+			if err := tarball.Append(h, strings.NewReader("model")); err != nil {
+				t.Fatal(closeTarball(tarball, err))
+			}
+			err = closeTarball(tarball, tt.err)
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			for _, want := range tt.want {
+				if !errors.Is(err, want) {
+					t.Errorf("got error %v, want it to wrap %v", err, want)
+				}
+			}
+			if errors.Is(err, errWriteLimit) && !strings.Contains(err.Error(), "failed to close tarball") {
+				t.Errorf("close error %v isn't described", err)
+			}
+		})
+	}
+}
+
+func TestTarballLongNames(t *testing.T) {
+	// longName has no directory to split off into the ustar prefix
+	longName := "voices/" + strings.Repeat("a", 120) + ".onnx"
+	// splitName fits the ustar format as prefix and name
+	splitName := strings.Repeat("d", 90) + "/" + strings.Repeat("b", 90) + ".onnx"
+	tests := []struct {
+		name    string
+		format  tar.Format
+		entry   string
+		wantErr string
+	}{
+		{"default", tar.FormatUnknown, longName, ""},
+		{"gnu", tar.FormatGNU, longName, ""},
+		{"pax", tar.FormatPAX, longName, ""},
+		{"ustar", tar.FormatUSTAR, longName, "too long for the ustar format; use the gnu or pax format"},
+		{"ustar prefix", tar.FormatUSTAR, splitName, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format := ArchiveFormats["tzst"]
+			var buf bytes.Buffer
+			tarball, err := NewTarballWriter(&buf, format, TarPerms{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tarball.headerFormat = tt.format
+			h := &tar.Header{Name: tt.entry, Mode: 0o644, Size: 5}
+			err = closeTarball(tarball, tarball.Append(h, strings.NewReader("model")))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reader, err := NewTarballReader(bytes.NewReader(buf.Bytes()), format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			var names []string
+			for {
+				h, _, err := reader.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				names = append(names, h.Name)
+			}
+			if !slices.Contains(names, tt.entry) {
+				t.Errorf("read back entries %q, want %q", names, tt.entry)
+			}
+		})
+	}
+}
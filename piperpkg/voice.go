@@ -0,0 +1,708 @@
+package piperpkg
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+	"github.com/zeebo/xxh3"
+)
+
+type voiceInfo struct {
+	ONNX      string
+	ModelCard string
+	JSON      string
+}
+
+// VoiceSpec names a voice and the URLs of its files: the .onnx model, its
+// .onnx.json config and optionally its MODEL_CARD.
+type VoiceSpec struct {
+	Name string
+	URLs []string
+	// Version, if set, is stamped into the voice's package in place of the
+	// version passed to InstallVoice.
+	Version string
+}
+
+var voiceQualities = []string{"x_low", "low", "medium", "high"}
+
+func voiceQuality(urls []string) string {
+	for _, url := range urls {
+		basename := filepath.Base(url)
+		if filepath.Ext(basename) != ".onnx" {
+			continue
+		}
+		stem := strings.TrimSuffix(basename, ".onnx")
+		quality := stem[strings.LastIndex(stem, "-")+1:]
+		if slices.Contains(voiceQualities, quality) {
+			return quality
+		}
+	}
+	return ""
+}
+
+// VoicePaths returns the paths in the piper voices repository of the model,
+// config and model card of the voice trained on dataset, e.g.
+// VoicePaths("en_GB", "alan", "medium").
+func VoicePaths(language, dataset, quality string) []string {
+	family, _, _ := strings.Cut(language, "_")
+	dir := path.Join(family, language, dataset, quality)
+	stem := language + "-" + dataset + "-" + quality
+	return []string{
+		path.Join(dir, stem+".onnx"),
+		path.Join(dir, stem+".onnx.json"),
+		path.Join(dir, "MODEL_CARD"),
+	}
+}
+
+func voiceLanguage(urls []string) string {
+	for _, url := range urls {
+		basename := filepath.Base(url)
+		if filepath.Ext(basename) != ".onnx" {
+			continue
+		}
+		if language, _, ok := strings.Cut(basename, "-"); ok {
+			return language
+		}
+	}
+	return ""
+}
+
+type voiceConfig struct {
+	Dataset string `json:"dataset"`
+	Audio   struct {
+		SampleRate int    `json:"sample_rate"`
+		Quality    string `json:"quality"`
+	} `json:"audio"`
+	Language struct {
+		Code           string `json:"code"`
+		NameEnglish    string `json:"name_english"`
+		CountryEnglish string `json:"country_english"`
+	} `json:"language"`
+	NumSpeakers  int            `json:"num_speakers"`
+	SpeakerIDMap map[string]int `json:"speaker_id_map"`
+}
+
+func (c voiceConfig) info() VoiceInfo {
+	info := VoiceInfo{
+		Dataset:    c.Dataset,
+		Language:   c.Language.Code,
+		Quality:    c.Audio.Quality,
+		SampleRate: c.Audio.SampleRate,
+		// configs of single speaker voices may leave out num_speakers
+		NumSpeakers: cmp.Or(c.NumSpeakers, len(c.SpeakerIDMap), 1),
+	}
+	if len(c.SpeakerIDMap) != 0 {
+		info.Speakers = maps.Clone(c.SpeakerIDMap)
+	}
+	return info
+}
+
+func readVoiceConfig(filename string) (voiceConfig, error) {
+	var config voiceConfig
+	src, err := os.ReadFile(filename)
+	if err != nil {
+		return config, fmt.Errorf("failed to read voice config: %w", err)
+	}
+	if err := json.Unmarshal(src, &config); err != nil {
+		return config, fmt.Errorf("failed to parse voice config %q: %w", filename, err)
+	}
+	return config, nil
+}
+
+func writeBundleDoc(pkgDir, embedPkgName string, names []string, configs map[string]voiceConfig) error {
+	doc := bytes.NewBuffer(nil)
+	fmt.Fprintf(doc, "// GENERATED FILE\n\n")
+	fmt.Fprintf(doc, "// Package %s embeds the piper voices:\n", embedPkgName)
+	fmt.Fprintf(doc, "//\n")
+	for _, name := range names {
+		config := configs[name]
+		fmt.Fprintf(doc, "//   - %s", name)
+		if config.Language.Code != "" {
+			fmt.Fprintf(doc, ": %s, %s", config.Language.Code, config.Audio.Quality)
+		}
+		fmt.Fprintf(doc, "\n")
+	}
+	fmt.Fprintf(doc, "package %s\n", embedPkgName)
+	return writeFileAtomic(filepath.Join(pkgDir, "doc.go"), doc.Bytes(), 0o644)
+}
+
+const maxDocSpeakers = 16
+
+func writeVoiceDoc(pkgDir, embedPkgName, name string, config voiceConfig, modelCard string) error {
+	language := config.Language.NameEnglish
+	if config.Language.CountryEnglish != "" {
+		language += " (" + config.Language.CountryEnglish + ")"
+	}
+	license := "https://huggingface.co/rhasspy/piper-voices"
+	if modelCard != "" {
+		license = modelCard
+	}
+
+	doc := bytes.NewBuffer(nil)
+	fmt.Fprintf(doc, "// GENERATED FILE\n\n")
+	fmt.Fprintf(doc, "// Package %s embeds the %q piper voice.\n", embedPkgName, name)
+	fmt.Fprintf(doc, "//\n")
+	if config.Language.Code != "" {
+		fmt.Fprintf(doc, "//   - Language: %s, %s\n", language, config.Language.Code)
+	}
+	if config.Audio.Quality != "" {
+		fmt.Fprintf(doc, "//   - Quality: %s\n", config.Audio.Quality)
+	}
+	if config.Audio.SampleRate != 0 {
+		fmt.Fprintf(doc, "//   - Sample rate: %d Hz\n", config.Audio.SampleRate)
+	}
+	if config.Dataset != "" {
+		fmt.Fprintf(doc, "//   - Dataset: %s\n", config.Dataset)
+	}
+	if n := len(config.SpeakerIDMap); n > maxDocSpeakers {
+		// some voices have hundreds of speakers, listed in the metadata
+		fmt.Fprintf(doc, "//   - Speakers: %d\n", n)
+	} else if n > 1 {
+		speakers := slices.SortedFunc(maps.Keys(config.SpeakerIDMap), func(a, b string) int {
+			return cmp.Compare(config.SpeakerIDMap[a], config.SpeakerIDMap[b])
+		})
+		for i, name := range speakers {
+			speakers[i] = fmt.Sprintf("%s (%d)", name, config.SpeakerIDMap[name])
+		}
+		fmt.Fprintf(doc, "//   - Speakers: %s\n", strings.Join(speakers, ", "))
+	}
+	fmt.Fprintf(doc, "//   - License: see %s\n", license)
+	fmt.Fprintf(doc, "package %s\n", embedPkgName)
+	return writeFileAtomic(filepath.Join(pkgDir, "doc.go"), doc.Bytes(), 0o644)
+}
+
+const compressedModelCard = "MODEL_CARD.txt.gz"
+
+func (b *PackageBuilder) modelCardName() string {
+	if b.CompressModelCard {
+		return compressedModelCard
+	}
+	return "MODEL_CARD.txt"
+}
+
+func modelCardFunc(bundle bool) string {
+	param, name := "", strconv.Quote(compressedModelCard)
+	if bundle {
+		param, name = "voice string", "voice + "+strconv.Quote("/"+compressedModelCard)
+	}
+	return `
+// ModelCard returns the text of the voice's MODEL_CARD.txt.
+func ModelCard(` + param + `) (string, error) {
+	f, err := fs.Open(` + name + `)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	text, err := io.ReadAll(r)
+	return string(text), err
+}
+`
+}
+
+func writeModelCard(dest, src string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("failed to read %q: %w", src, err)
+	}
+	text := decodeText(data)
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	lines := strings.Split(strings.TrimRight(text, " \t\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	data = []byte(strings.Join(lines, "\n") + "\n")
+	if filepath.Ext(dest) == ".gz" {
+		var compressed bytes.Buffer
+		if err := gzipText(&compressed, data); err != nil {
+			return fmt.Errorf("failed to compress %q: %w", src, err)
+		}
+		log.Debug().Str("file", dest).Int("size", len(data)).Int("compressed", compressed.Len()).Msg("compressed model card")
+		data = compressed.Bytes()
+	}
+	if err := writeFileAtomic(dest, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write %q: %w", dest, err)
+	}
+	return nil
+}
+
+func gzipText(w io.Writer, data []byte) error {
+	zw, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+	if err != nil {
+		return fmt.Errorf("failed to create gzip writer: %w", err)
+	}
+	if _, err := zw.Write(data); err != nil {
+		zw.Close()
+		return fmt.Errorf("failed to write gzip stream: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to close gzip stream: %w", err)
+	}
+	return nil
+}
+
+func decodeText(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xef, 0xbb, 0xbf}):
+		data = data[3:]
+	case len(data)%2 == 0 && (bytes.HasPrefix(data, []byte{0xff, 0xfe}) || bytes.HasPrefix(data, []byte{0xfe, 0xff})):
+		order := binary.ByteOrder(binary.LittleEndian)
+		if data[0] == 0xfe {
+			order = binary.BigEndian
+		}
+		units := make([]uint16, 0, len(data)/2-1)
+		for i := 2; i < len(data); i += 2 {
+			units = append(units, order.Uint16(data[i:]))
+		}
+		return string(utf16.Decode(units))
+	}
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+func checkONNX(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header := make([]byte, 1)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return err
+	}
+	if header[0] != 0x08 {
+		return fmt.Errorf("file doesn't look like an ONNX model (starts with %#02x)", header[0])
+	}
+	return nil
+}
+
+type voiceFiles struct {
+	ModelCard string
+	Config    string
+	// Shared maps entries left out of the tarball to their hash in the
+	// shared package.
+	Shared map[string]Hash
+}
+
+func voiceEntryName(url string) (string, error) {
+	basename := filepath.Base(url)
+	extension := filepath.Ext(basename)
+	switch {
+	case basename == "MODEL_CARD":
+		return basename, nil
+	case extension == ".onnx":
+		return "voice.onnx", nil
+	case extension == ".json":
+		return "voice.json", nil
+	default:
+		return "", fmt.Errorf("encountered unexpected file extension %q", extension)
+	}
+}
+
+func (b *PackageBuilder) entryName(url string) (name, role string, err error) {
+	role, err = voiceEntryName(url)
+	if b.EntryName != nil {
+		if name := b.EntryName(url); name != "" {
+			return name, role, nil
+		}
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return role, role, nil
+}
+
+func (b *PackageBuilder) appendVoice(ctx context.Context, tarball *Tarball, prefix string, urls []string, shared map[Hash]string) (voiceFiles, error) {
+	files := voiceFiles{Shared: map[string]Hash{}}
+	counts := map[string]int{}
+	for _, url := range urls {
+		_, role, err := b.entryName(url)
+		if err != nil {
+			return files, err
+		}
+		counts[role]++
+	}
+	for _, basename := range []string{"voice.onnx", "voice.json", "MODEL_CARD"} {
+		if counts[basename] > 1 || (counts[basename] == 0 && basename != "MODEL_CARD") {
+			return files, fmt.Errorf("expected exactly one %s, got %d", basename, counts[basename])
+		}
+	}
+	for _, url := range urls {
+		name, role, _ := b.entryName(url)
+		filename, err := b.Downloader.Download(ctx, url)
+		if err != nil {
+			return files, fmt.Errorf("failed to download voice: %w", err)
+		}
+		if role == "voice.onnx" {
+			if err := checkONNX(filename); err != nil {
+				return files, fmt.Errorf("invalid model %q: %w", url, err)
+			}
+		}
+		sharedHash, err := b.sharedFileHash(shared, url)
+		if err != nil {
+			return files, err
+		}
+		switch {
+		case role == "MODEL_CARD" && b.ModelCardSidecar:
+			// only embedded as MODEL_CARD.txt next to the archive
+		case sharedHash != nil:
+			files.Shared[prefix+name] = *sharedHash
+		default:
+			if err := tarball.AppendFile(prefix+name, filename); err != nil {
+				return files, fmt.Errorf("failed to add %q to tarball: %w", filename, err)
+			}
+		}
+		switch role {
+		case "MODEL_CARD":
+			files.ModelCard = filename
+		case "voice.json":
+			files.Config = filename
+		}
+	}
+	return files, nil
+}
+
+func (b *PackageBuilder) voiceHashes(ctx context.Context, urls []string) (map[string]Hash, error) {
+	hashes := map[string]Hash{}
+	for _, url := range urls {
+		name, role, err := b.entryName(url)
+		if err != nil {
+			return nil, err
+		}
+		if role == "MODEL_CARD" && b.ModelCardSidecar {
+			continue
+		}
+		if _, err := b.Downloader.Download(ctx, url); err != nil {
+			return nil, fmt.Errorf("failed to download voice: %w", err)
+		}
+		if hashes[name], err = b.Downloader.Hash(url); err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+// VoicePackageName returns the name of the package generated for voice.
+func VoicePackageName(voice VoiceSpec) string {
+	packageName := "piper-voice-" + voice.Name
+	if quality := voiceQuality(voice.URLs); quality != "" {
+		packageName += "-" + quality
+	}
+	return packageName
+}
+
+// InstallVoice generates the piper-voice-<name> package for voice.
+func (b *PackageBuilder) InstallVoice(ctx context.Context, voice VoiceSpec, version string, shared *SharedPackage) (_ *Package, retErr error) {
+	name, urls := voice.Name, voice.URLs
+	version = cmp.Or(voice.Version, version)
+	loc := VoiceLocation(voice)
+	packageName, err := b.PackageName(loc)
+	if err != nil {
+		return nil, err
+	}
+	embedPkgName := packageIdentifier(name)
+	packagePath := b.modulePath(packageName)
+	if err := b.checkMajorVersion(version); err != nil {
+		return nil, err
+	}
+	pkgDir, err := b.PackageDir(loc)
+	if err != nil {
+		return nil, err
+	}
+	// phonemizer data isn't tracked by voiceHashes, so always regenerate
+	if b.Incremental && b.PhonemizerData == "" {
+		hashes, err := b.voiceHashes(ctx, urls)
+		if err != nil {
+			return nil, err
+		}
+		if meta, ok := b.unchanged(pkgDir, version, hashes); ok {
+			log.Info().Str("package", packageName).Msg("voice files unchanged, keeping existing package")
+			return newVoicePackage(packageName, packagePath, filepath.Join(pkgDir, b.archiveFilename()), meta, urls)
+		}
+	}
+	packageDirectory, commit, err := b.stagePackage(pkgDir)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { retErr = commit(retErr) }()
+
+	archiveFilename := filepath.Join(packageDirectory, b.archiveFilename())
+	tarball, err := b.newVoiceTarball(archiveFilename, pkgDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tarball: %w", err)
+	}
+
+	var sharedFiles map[Hash]string
+	if shared != nil {
+		sharedFiles = shared.Files
+	}
+	files, err := b.appendVoice(ctx, tarball, "", urls, sharedFiles)
+	if err != nil {
+		return nil, closeTarball(tarball, fmt.Errorf("failed to add voice %q: %w", name, err))
+	}
+	var phonemizerData string
+	if b.PhonemizerData != "" {
+		if err := b.appendPhonemizerData(ctx, tarball, ""); err != nil {
+			return nil, closeTarball(tarball, fmt.Errorf("failed to add phonemizer data: %w", err))
+		}
+		phonemizerData = PhonemizerDataDir
+	}
+
+	if err := closeTarball(tarball, nil); err != nil {
+		return nil, err
+	}
+	if tarball.reused != 0 {
+		log.Info().Str("package", packageName).Int("files", tarball.reused).Msg("reused compressed files of existing archive")
+	}
+	var embedPaths []string
+	if files.ModelCard != "" {
+		if err := writeModelCard(filepath.Join(packageDirectory, b.modelCardName()), files.ModelCard); err != nil {
+			return nil, fmt.Errorf("failed to copy MODEL_CARD.txt into package: %w", err)
+		}
+		embedPaths = append(embedPaths, b.modelCardName())
+	} else {
+		log.Warn().Str("voice", name).Msg("voice has no MODEL_CARD")
+	}
+	var (
+		language  string
+		voiceInfo *VoiceInfo
+	)
+	if files.Config != "" {
+		config, err := readVoiceConfig(files.Config)
+		if err != nil {
+			return nil, err
+		}
+		language = config.Language.Code
+		info := config.info()
+		voiceInfo = &info
+		modelCard := ""
+		if files.ModelCard != "" {
+			modelCard = b.modelCardName()
+		}
+		if err := writeVoiceDoc(packageDirectory, embedPkgName, name, config, modelCard); err != nil {
+			return nil, fmt.Errorf("failed to write doc.go: %w", err)
+		}
+		if b.VoiceConfigGo {
+			if err := writeVoiceConfigGo(packageDirectory, embedPkgName, files.Config); err != nil {
+				return nil, fmt.Errorf("failed to write config.go: %w", err)
+			}
+		}
+	}
+	assets := []packageAsset{{Var: "Asset", Name: name}}
+	var deps []packageDep
+	if len(files.Shared) != 0 {
+		ident := packageIdentifier(shared.Name)
+		if ident == embedPkgName {
+			ident += "_shared"
+		}
+		assets[0].Base = ident + ".Asset"
+		deps = append(deps, packageDep{Ident: ident, Path: shared.Path, Version: shared.Version, Dir: shared.Dir})
+	} else {
+		files.Shared = nil
+	}
+	if err := b.writeGenerate(packageDirectory, embedPkgName, name); err != nil {
+		return nil, fmt.Errorf("failed to write generate.go: %w", err)
+	}
+	meta, err := b.generatePackage(ctx, true, packageDirectory, embedPkgName, packagePath, assets, deps, Meta{
+		Version:  version,
+		Files:    tarball.Hashes(),
+		Sources:  urls,
+		Shared:   files.Shared,
+		Language: language,
+		Voice:    voiceInfo,
+		Members:  tarball.Members(),
+
+		UncompressedSize: tarball.UncompressedSize(),
+
+		ResolvedSources: b.Downloader.ResolvedURLs(urls),
+		PhonemizerData:  phonemizerData,
+	}, embedPaths...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate package: %w", err)
+	}
+	return newVoicePackage(packageName, packagePath, archiveFilename, meta, urls)
+}
+
+func newVoicePackage(name, path, archiveFilename string, meta Meta, urls []string) (*Package, error) {
+	pkg, err := newPackage(KindVoice, name, path, archiveFilename, meta)
+	if err != nil {
+		return nil, err
+	}
+	pkg.Quality = voiceQuality(urls)
+	return pkg, nil
+}
+
+func exportedIdentifier(ident string) string {
+	r, size := utf8.DecodeRuneInString(ident)
+	if upper := unicode.ToUpper(r); unicode.IsUpper(upper) {
+		return string(upper) + ident[size:]
+	}
+	return "Voice_" + ident
+}
+
+// BundlePackageName returns the name of the package generated for a bundle.
+func BundlePackageName(bundleName string) string {
+	return "piper-voices-" + bundleName
+}
+
+// InstallVoiceBundle generates a single package containing several voices,
+// each under its own directory in the tarball and exposed as its own Asset.
+func (b *PackageBuilder) InstallVoiceBundle(ctx context.Context, bundleName string, version string, voices []VoiceSpec) (_ *Package, retErr error) {
+	packageName := BundlePackageName(bundleName)
+	if err := checkModulePathElement(packageName); err != nil {
+		return nil, fmt.Errorf("invalid bundle name %q: %w", bundleName, err)
+	}
+	embedPkgName := packageIdentifier(bundleName)
+	packagePath := b.modulePath(packageName)
+	if err := b.checkMajorVersion(version); err != nil {
+		return nil, err
+	}
+	pkgDir, err := b.PackageDir(BundleLocation(bundleName))
+	if err != nil {
+		return nil, err
+	}
+	voices = slices.Clone(voices)
+	slices.SortFunc(voices, func(x, y VoiceSpec) int { return strings.Compare(x.Name, y.Name) })
+	names := make([]string, 0, len(voices))
+	vars := map[string]string{}
+	for _, voice := range voices {
+		ident := exportedIdentifier(packageIdentifier(voice.Name))
+		if other, ok := vars[ident]; ok {
+			return nil, fmt.Errorf("voices %q and %q both map to %s", other, voice.Name, ident)
+		}
+		vars[ident] = voice.Name
+		names = append(names, voice.Name)
+	}
+
+	packageDirectory, commit, err := b.stagePackage(pkgDir)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { retErr = commit(retErr) }()
+
+	archiveFilename := filepath.Join(packageDirectory, b.archiveFilename())
+	tarball, err := b.newTarball(archiveFilename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tarball: %w", err)
+	}
+
+	var (
+		sources    []string
+		embedPaths []string
+		assets     []packageAsset
+		configs    = map[string]voiceConfig{}
+	)
+	for _, voice := range voices {
+		name := voice.Name
+		files, err := b.appendVoice(ctx, tarball, name+"/", voice.URLs, nil)
+		if err != nil {
+			return nil, closeTarball(tarball, fmt.Errorf("failed to add voice %q: %w", name, err))
+		}
+		if files.ModelCard != "" {
+			modelCard := path.Join(name, b.modelCardName())
+			if err := os.MkdirAll(filepath.Join(packageDirectory, name), 0o755); err != nil {
+				return nil, closeTarball(tarball, fmt.Errorf("failed to create directory for voice %q: %w", name, err))
+			}
+			if err := writeModelCard(filepath.Join(packageDirectory, filepath.FromSlash(modelCard)), files.ModelCard); err != nil {
+				return nil, closeTarball(tarball, fmt.Errorf("failed to copy MODEL_CARD.txt into package: %w", err))
+			}
+			embedPaths = append(embedPaths, modelCard)
+		} else {
+			log.Warn().Str("voice", name).Msg("voice has no MODEL_CARD")
+		}
+		if files.Config != "" {
+			config, err := readVoiceConfig(files.Config)
+			if err != nil {
+				return nil, closeTarball(tarball, err)
+			}
+			configs[name] = config
+		}
+		assets = append(assets, packageAsset{
+			Var:  exportedIdentifier(packageIdentifier(name)),
+			Name: name,
+			Dir:  name,
+		})
+		sources = append(sources, voice.URLs...)
+	}
+	var phonemizerData string
+	if b.PhonemizerData != "" {
+		if err := b.appendPhonemizerData(ctx, tarball, ""); err != nil {
+			return nil, closeTarball(tarball, fmt.Errorf("failed to add phonemizer data: %w", err))
+		}
+		phonemizerData = PhonemizerDataDir
+	}
+
+	if err := closeTarball(tarball, nil); err != nil {
+		return nil, err
+	}
+	if err := writeBundleDoc(packageDirectory, embedPkgName, names, configs); err != nil {
+		return nil, fmt.Errorf("failed to write doc.go: %w", err)
+	}
+	if err := b.writeGenerate(packageDirectory, embedPkgName, names...); err != nil {
+		return nil, fmt.Errorf("failed to write generate.go: %w", err)
+	}
+	files := tarball.Hashes()
+	voiceConfigs := map[string]VoiceInfo{}
+	for name, config := range configs {
+		voiceConfigs[name] = config.info()
+	}
+	meta, err := b.generatePackage(ctx, true, packageDirectory, embedPkgName, packagePath, assets, nil, Meta{
+		Version: version,
+		Files:   files,
+		Voices:  bundleHashes(names, files),
+		Sources: sources,
+
+		VoiceConfigs: voiceConfigs,
+
+		UncompressedSize: tarball.UncompressedSize(),
+
+		ResolvedSources: b.Downloader.ResolvedURLs(sources),
+		PhonemizerData:  phonemizerData,
+	}, embedPaths...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate package: %w", err)
+	}
+	return newPackage(KindBundle, packageName, packagePath, archiveFilename, meta)
+}
+
+func bundleHashes(names []string, files map[string]Hash) map[string]Hash {
+	hashes := map[string]Hash{}
+	for _, name := range names {
+		h := xxh3.New()
+		for _, filename := range slices.Sorted(maps.Keys(files)) {
+			if !strings.HasPrefix(filename, name+"/") {
+				continue
+			}
+			fmt.Fprintf(h, "%s %s\n", filename, files[filename])
+		}
+		hashes[name] = Hash(h.Sum128())
+	}
+	return hashes
+}
@@ -0,0 +1,275 @@
+package piperpkg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportedIdentifier(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"jenny", "Jenny"},
+		{"en_GB_alba", "En_GB_alba"},
+		{"élodie", "Élodie"},
+		{"ωmega", "Ωmega"},
+		{"语音", "Voice_语音"},
+		{"pkg_1", "Pkg_1"},
+	}
+	for _, tt := range tests {
+		ident := packageIdentifier(tt.name)
+		if got := exportedIdentifier(ident); got != tt.want {
+			t.Errorf("exportedIdentifier(%q) = %q, want %q", ident, got, tt.want)
+		}
+	}
+}
+
+func TestAppendVoiceFileCounts(t *testing.T) {
+	files := testVoiceFiles()
+	files["/voices/en_GB-other-low.onnx"] = testONNX()
+	files["/voices/en_GB-other-low.onnx.json"] = []byte(testVoiceJSON)
+	s := newFixtureServer(t, files)
+	var (
+		onnx         = s.URL + "/voices/en_GB-test-low.onnx"
+		otherONNX    = s.URL + "/voices/en_GB-other-low.onnx"
+		config       = s.URL + "/voices/en_GB-test-low.onnx.json"
+		otherJSON    = s.URL + "/voices/en_GB-other-low.onnx.json"
+		modelCard    = s.URL + "/voices/MODEL_CARD"
+		onnxErr      = "expected exactly one voice.onnx"
+		configErr    = "expected exactly one voice.json"
+		modelCardErr = "expected exactly one MODEL_CARD"
+	)
+	tests := []struct {
+		name    string
+		urls    []string
+		wantErr string
+	}{
+		{"one of each", []string{onnx, config, modelCard}, ""},
+		{"no model card", []string{onnx, config}, ""},
+		{"no onnx", []string{config, modelCard}, onnxErr + ", got 0"},
+		{"two onnx", []string{onnx, otherONNX, config}, onnxErr + ", got 2"},
+		{"no json", []string{onnx, modelCard}, configErr + ", got 0"},
+		{"two json", []string{onnx, config, otherJSON}, configErr + ", got 2"},
+		{"two model cards", []string{onnx, config, modelCard, modelCard}, modelCardErr + ", got 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBuilder(t, s)
+			tarball, err := b.newTarball(filepath.Join(t.TempDir(), "dist.tzst"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = b.appendVoice(context.Background(), tarball, "", tt.urls, nil)
+			if err := closeTarball(tarball, err); tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInstallVoiceModelCardNormalized(t *testing.T) {
+	raw, err := os.ReadFile(filepath.Join("testdata", "crlf", "MODEL_CARD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := testVoiceFiles()
+	files["/voices/MODEL_CARD"] = raw
+	s := newFixtureServer(t, files)
+	b := newTestBuilder(t, s)
+	voice := VoiceSpec{Name: "test", URLs: []string{
+		s.URL + "/voices/en_GB-test-low.onnx",
+		s.URL + "/voices/en_GB-test-low.onnx.json",
+		s.URL + "/voices/MODEL_CARD",
+	}}
+	if _, err := b.InstallVoice(context.Background(), voice, "v1.0.0", nil); err != nil {
+		t.Fatal(err)
+	}
+	pkgDir := filepath.Join(b.Dir, "piper-voice-test-low")
+	want := "# Model card for test\n\nDataset: café\nLicense: CC0\n"
+	if got := readFile(t, filepath.Join(pkgDir, "MODEL_CARD.txt")); got != want {
+		t.Errorf("MODEL_CARD.txt is %q, want %q", got, want)
+	}
+	// the archive keeps the model card as downloaded
+	_, contents := readArchive(t, filepath.Join(pkgDir, "dist.tzst"))
+	if got := contents["MODEL_CARD"]; got != string(raw) {
+		t.Errorf("archived MODEL_CARD is %q, want %q", got, raw)
+	}
+}
+
+func TestInstallVoiceIncrementalReusesFrames(t *testing.T) {
+	s := newFixtureServer(t, testVoiceFiles())
+	b := newTestBuilder(t, s)
+	b.Incremental = true
+	voice := VoiceSpec{Name: "test", URLs: []string{
+		s.URL + "/voices/en_GB-test-low.onnx",
+		s.URL + "/voices/en_GB-test-low.onnx.json",
+		s.URL + "/voices/MODEL_CARD",
+	}}
+	ctx := context.Background()
+	if _, err := b.InstallVoice(ctx, voice, "v1.0.0", nil); err != nil {
+		t.Fatal(err)
+	}
+	pkgDir := filepath.Join(b.Dir, "piper-voice-test-low")
+	prevFilename := filepath.Join(t.TempDir(), "dist.tzst")
+	if err := os.WriteFile(prevFilename, []byte(readFile(t, filepath.Join(pkgDir, "dist.tzst"))), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	prevMeta := checkMeta(t, pkgDir, map[string]string{
+		"voice.onnx": string(testONNX()),
+		"voice.json": testVoiceJSON,
+		"MODEL_CARD": testModelCard,
+	}, "dist.tzst", "MODEL_CARD.txt")
+
+	config := strings.Replace(testVoiceJSON, "22050", "16000", 1)
+	s.set("/voices/en_GB-test-low.onnx.json", []byte(config))
+	// drop the cached download so the changed config is fetched
+	if err := b.Downloader.Evict(voice.URLs[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.InstallVoice(ctx, voice, "v1.0.0", nil); err != nil {
+		t.Fatal(err)
+	}
+	meta := checkMeta(t, pkgDir, map[string]string{
+		"voice.onnx": string(testONNX()),
+		"voice.json": config,
+		"MODEL_CARD": testModelCard,
+	}, "dist.tzst", "MODEL_CARD.txt")
+	if meta.Voice == nil || meta.Voice.SampleRate != 16000 {
+		t.Errorf("voice has info %+v", meta.Voice)
+	}
+	filename := filepath.Join(pkgDir, "dist.tzst")
+	for _, name := range []string{"voice.onnx", "voice.json", "MODEL_CARD"} {
+		reused := bytes.Equal(frame(t, filename, meta.Members[name]), frame(t, prevFilename, prevMeta.Members[name]))
+		if want := name != "voice.json"; reused != want {
+			t.Errorf("frame of %s reused: %v, want %v", name, reused, want)
+		}
+	}
+}
+
+func TestInstallVoiceMinModelSize(t *testing.T) {
+	notONNX := testONNX()
+	notONNX[0] = '<'
+	tests := []struct {
+		name    string
+		onnx    []byte
+		minSize int64
+		wantErr string
+	}{
+		// only MinSizes limits the size, even below DefaultMinSizes
+		{"at minimum", testONNX(), int64(len(testONNX())), ""},
+		{"below minimum", testONNX(), int64(len(testONNX())) + 1, "expected at least 1025"},
+		{"not onnx", notONNX, 1, "doesn't look like an ONNX model"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := testVoiceFiles()
+			files["/voices/en_GB-test-low.onnx"] = tt.onnx
+			s := newFixtureServer(t, files)
+			b := newTestBuilder(t, s)
+			b.Downloader.MinSizes = map[string]int64{"": 1, ".onnx": tt.minSize}
+			voice := VoiceSpec{Name: "test", URLs: []string{
+				s.URL + "/voices/en_GB-test-low.onnx",
+				s.URL + "/voices/en_GB-test-low.onnx.json",
+			}}
+			_, err := b.InstallVoice(context.Background(), voice, "v1.0.0", nil)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// limitedWriter fails once more than n bytes are written to it.
+type limitedWriter struct {
+	n int
+}
+
+var errWriteLimit = errors.New("write limit reached")
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		written := w.n
+		w.n = 0
+		return written, errWriteLimit
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestInstallVoiceBundleIdentifierCollision(t *testing.T) {
+	files, voices := testVoices(t)
+	s := newFixtureServer(t, files)
+	b := newTestBuilder(t, s)
+	specs := voices(s)
+	specs[0].Name = "a-b"
+	specs[1].Name = "a_b"
+	_, err := b.InstallVoiceBundle(context.Background(), "test", "v1.0.0", specs)
+	if err == nil || !strings.Contains(err.Error(), `"a-b"`) || !strings.Contains(err.Error(), `"a_b"`) {
+		t.Fatalf("InstallVoiceBundle error = %v, want one naming both voices", err)
+	}
+	if _, err := os.Stat(filepath.Join(b.Dir, "piper-voices-test")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("bundle package created despite the collision: %v", err)
+	}
+}
+
+func TestInstallVoiceBundleInvalidConfig(t *testing.T) {
+	files, voices := testVoices(t)
+	files["/beta/en_GB-beta-low.onnx.json"] = []byte("{")
+	s := newFixtureServer(t, files)
+	b := newTestBuilder(t, s)
+	if _, err := b.InstallVoiceBundle(context.Background(), "test", "v1.0.0", voices(s)); err == nil {
+		t.Fatal("InstallVoiceBundle succeeded with an invalid voice config")
+	}
+	entries, err := os.ReadDir(b.Dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("left %d entries in %s", len(entries), b.Dir)
+	}
+}
+
+func TestGzipTextErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int
+		wantErr string
+	}{
+		// the header is written with the first data, the rest when closing
+		{"header", 0, "failed to write gzip stream"},
+		{"body", 10, "failed to close gzip stream"},
+		{"none", 1 << 20, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := gzipText(&limitedWriter{n: tt.limit}, []byte(testModelCard))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !errors.Is(err, errWriteLimit) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package piperpkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type fullVoiceConfig struct {
+	Dataset      string `json:"dataset"`
+	PiperVersion string `json:"piper_version"`
+	Audio        struct {
+		SampleRate int    `json:"sample_rate"`
+		Quality    string `json:"quality"`
+	} `json:"audio"`
+	Language struct {
+		Code           string `json:"code"`
+		Family         string `json:"family"`
+		Region         string `json:"region"`
+		NameNative     string `json:"name_native"`
+		NameEnglish    string `json:"name_english"`
+		CountryEnglish string `json:"country_english"`
+	} `json:"language"`
+	ESpeak struct {
+		Voice string `json:"voice"`
+	} `json:"espeak"`
+	Inference struct {
+		NoiseScale  float64 `json:"noise_scale"`
+		LengthScale float64 `json:"length_scale"`
+		NoiseW      float64 `json:"noise_w"`
+	} `json:"inference"`
+	PhonemeType  string              `json:"phoneme_type"`
+	PhonemeMap   map[string][]string `json:"phoneme_map"`
+	PhonemeIDMap map[string][]int    `json:"phoneme_id_map"`
+	NumSymbols   int                 `json:"num_symbols"`
+	NumSpeakers  int                 `json:"num_speakers"`
+	SpeakerIDMap map[string]int      `json:"speaker_id_map"`
+}
+
+const voiceConfigTypes = `
+// VoiceConfig is the parsed voice.json of a piper voice.
+type VoiceConfig struct {
+	Dataset      string
+	PiperVersion string
+	// SampleRate is the rate in Hz of the audio the voice produces.
+	SampleRate int
+	Quality    string
+	Language   LanguageConfig
+	// ESpeakVoice is the espeak-ng voice used for phonemization.
+	ESpeakVoice string
+	Inference   InferenceConfig
+	PhonemeType string
+	// PhonemeMap maps phonemes to their replacements, and PhonemeIDMap
+	// phonemes to the model's input IDs.
+	PhonemeMap   map[string][]string
+	PhonemeIDMap map[string][]int
+	NumSymbols   int
+	NumSpeakers  int
+	// SpeakerIDMap maps speaker names to the IDs of a multi-speaker voice.
+	SpeakerIDMap map[string]int
+}
+
+// LanguageConfig describes the language of a voice.
+type LanguageConfig struct {
+	Code           string
+	Family         string
+	Region         string
+	NameNative     string
+	NameEnglish    string
+	CountryEnglish string
+}
+
+// InferenceConfig holds the default synthesis parameters of a voice.
+type InferenceConfig struct {
+	NoiseScale  float64
+	LengthScale float64
+	NoiseW      float64
+}
+`
+
+func writeVoiceConfigGo(pkgDir, embedPkgName, configFilename string) error {
+	src, err := os.ReadFile(configFilename)
+	if err != nil {
+		return fmt.Errorf("failed to read voice config: %w", err)
+	}
+	var config fullVoiceConfig
+	if err := json.Unmarshal(src, &config); err != nil {
+		return fmt.Errorf("failed to parse voice config %q: %w", configFilename, err)
+	}
+
+	var lit strings.Builder
+	field := func(name, value string) {
+		fmt.Fprintf(&lit, "\t\t%s: %s,\n", name, value)
+	}
+	field("Dataset", strconv.Quote(config.Dataset))
+	field("PiperVersion", strconv.Quote(config.PiperVersion))
+	field("SampleRate", strconv.Itoa(config.Audio.SampleRate))
+	field("Quality", strconv.Quote(config.Audio.Quality))
+	field("Language", fmt.Sprintf("LanguageConfig{Code: %q, Family: %q, Region: %q, NameNative: %q, NameEnglish: %q, CountryEnglish: %q}",
+		config.Language.Code, config.Language.Family, config.Language.Region,
+		config.Language.NameNative, config.Language.NameEnglish, config.Language.CountryEnglish))
+	field("ESpeakVoice", strconv.Quote(config.ESpeak.Voice))
+	field("Inference", "InferenceConfig{NoiseScale: "+formatFloat(config.Inference.NoiseScale)+
+		", LengthScale: "+formatFloat(config.Inference.LengthScale)+
+		", NoiseW: "+formatFloat(config.Inference.NoiseW)+"}")
+	field("PhonemeType", strconv.Quote(config.PhonemeType))
+	field("PhonemeMap", mapLiteral("map[string][]string", config.PhonemeMap, func(v []string) string {
+		quoted := make([]string, len(v))
+		for i, s := range v {
+			quoted[i] = strconv.Quote(s)
+		}
+		return "{" + strings.Join(quoted, ", ") + "}"
+	}))
+	field("PhonemeIDMap", mapLiteral("map[string][]int", config.PhonemeIDMap, func(v []int) string {
+		ids := make([]string, len(v))
+		for i, id := range v {
+			ids[i] = strconv.Itoa(id)
+		}
+		return "{" + strings.Join(ids, ", ") + "}"
+	}))
+	field("NumSymbols", strconv.Itoa(config.NumSymbols))
+	field("NumSpeakers", strconv.Itoa(config.NumSpeakers))
+	field("SpeakerIDMap", mapLiteral("map[string]int", config.SpeakerIDMap, strconv.Itoa))
+
+	configGo, err := format.Source([]byte(`// GENERATED FILE
+
+package ` + embedPkgName + `
+` + voiceConfigTypes + `
+// Config returns the parsed voice.json of the voice. Each call returns a new
+// copy, which callers may modify.
+func Config() VoiceConfig {
+	return VoiceConfig{
+` + lit.String() + `	}
+}
+`))
+	if err != nil {
+		return fmt.Errorf("failed to format config.go: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(pkgDir, "config.go"), configGo, 0o644)
+}
+
+func mapLiteral[V any](typ string, m map[string]V, value func(V) string) string {
+	if len(m) == 0 {
+		return "nil"
+	}
+	var lit strings.Builder
+	lit.WriteString(typ + "{\n")
+	for _, key := range slices.Sorted(maps.Keys(m)) {
+		lit.WriteString(strconv.Quote(key) + ": " + value(m[key]) + ",\n")
+	}
+	lit.WriteString("}")
+	return lit.String()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}